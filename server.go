@@ -1,31 +1,69 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/acme/autocert"
+	_ "modernc.org/sqlite"
 )
 
 // User represents a player with their scores
 type User struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Scores    Scores    `json:"scores"`
-	CreatedAt time.Time `json:"created_at"`
+	ID          string            `json:"id"`
+	Username    string            `json:"username"`
+	Scores      Scores            `json:"scores"`
+	SizeScores  map[int]*Scores   `json:"size_scores,omitempty"` // online results by board size
+	Guest       bool              `json:"guest,omitempty"`       // ephemeral account, never persisted
+	Preferences map[string]string `json:"preferences,omitempty"` // client UI settings, see handlePreferences
+	CreatedAt   time.Time         `json:"created_at"`
+
+	// Think time over online moves, for the speed leaderboard
+	MoveSeconds    float64 `json:"move_seconds,omitempty"` // total seconds taken over TimedMoves
+	TimedMoves     int     `json:"timed_moves,omitempty"`
+	AvgMoveSeconds float64 `json:"avg_move_seconds,omitempty"`
 }
 
 // Scores tracks wins, losses, and draws
 type Scores struct {
-	Wins   int `json:"wins"`
-	Losses int `json:"losses"`
-	Draws  int `json:"draws"`
+	Wins     int `json:"wins"`
+	Losses   int `json:"losses"`
+	Draws    int `json:"draws"`
+	Forfeits int `json:"forfeits,omitempty"` // games forfeited, under the "forfeit" scoring policy
 }
 
 // Database holds all users
@@ -36,29 +74,232 @@ type Database struct {
 
 // Session stores active user sessions
 type SessionStore struct {
-	sessions map[string]string // token -> userID
-	mu       sync.RWMutex
+	sessions map[string]*list.Element // token -> entry in lru
+	lru      *list.List               // *session values, most recently used first
+	max      int                      // cap on sessions, 0 for unlimited
+	mu       sync.Mutex
+
+	// OnEnd, if set, receives the user ID of each session that is
+	// removed or evicted. It is called after mu is released.
+	OnEnd func(userID string)
+}
+
+// session is one logged-in token
+type session struct {
+	token  string
+	userID string
+}
+
+// create starts a session for userID and returns its token, evicting the
+// least recently used session if the store is full
+func (s *SessionStore) create(userID string) string {
+	token := generateToken()
+
+	s.mu.Lock()
+	s.sessions[token] = s.lru.PushFront(&session{token: token, userID: userID})
+	var evicted []string
+	for s.max > 0 && s.lru.Len() > s.max {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.sessions, oldest.Value.(*session).token)
+		evicted = append(evicted, oldest.Value.(*session).userID)
+	}
+	s.mu.Unlock()
+
+	s.ended(evicted...)
+	return token
+}
+
+// ended reports ended sessions' users to OnEnd
+func (s *SessionStore) ended(userIDs ...string) {
+	if s.OnEnd == nil {
+		return
+	}
+	for _, userID := range userIDs {
+		s.OnEnd(userID)
+	}
+}
+
+// lookup returns the user ID for token, marking the session as used
+func (s *SessionStore) lookup(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.sessions[token]
+	if !ok {
+		return "", false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*session).userID, true
+}
+
+// remove ends the session for token, if any
+func (s *SessionStore) remove(token string) {
+	s.mu.Lock()
+	elem, ok := s.sessions[token]
+	if ok {
+		s.lru.Remove(elem)
+		delete(s.sessions, token)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.ended(elem.Value.(*session).userID)
+	}
+}
+
+// removeUser ends every session belonging to userID
+func (s *SessionStore) removeUser(userID string) {
+	s.mu.Lock()
+	removed := false
+	for elem := s.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if sess := elem.Value.(*session); sess.userID == userID {
+			s.lru.Remove(elem)
+			delete(s.sessions, sess.token)
+			removed = true
+		}
+		elem = next
+	}
+	s.mu.Unlock()
+
+	if removed {
+		s.ended(userID)
+	}
 }
 
 // GameRoom represents an online multiplayer game
 type GameRoom struct {
-	ID          string    `json:"id"`
-	Code        string    `json:"code"` // 6-char join code
-	BoardSize   int       `json:"board_size"`
-	Board       []string  `json:"board"`
-	PlayerX     *User     `json:"player_x"`
-	PlayerO     *User     `json:"player_o"`
-	CurrentTurn string    `json:"current_turn"` // "X" or "O"
-	Status      string    `json:"status"`       // "waiting", "playing", "finished"
-	Winner      string    `json:"winner"`       // "X", "O", "draw", or ""
-	WinningLine []int     `json:"winning_line"` // indices of winning cells
-	LastMove    int       `json:"last_move"`    // index of last move
-	ShowEmote   bool      `json:"show_emote"`   // whether to show emote
-	EmoteType   string    `json:"emote_type"`   // type of emote (e.g., "deal_with_it")
-	EmoteBy     string    `json:"emote_by"`     // username who triggered it
-	EmoteAt     time.Time `json:"emote_at"`     // when emote was triggered
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID               string     `json:"id"`
+	Code             string     `json:"code"` // 6-char join code
+	BoardSize        int        `json:"board_size"`
+	WinLength        int        `json:"win_length"`  // marks in a row needed to win
+	WinPattern       string     `json:"win_pattern"` // "line", or "square"/"corners" to also win on that shape
+	Board            []string   `json:"board"`
+	PlayerX          *User      `json:"player_x"`
+	PlayerO          *User      `json:"player_o"`
+	CurrentTurn      string     `json:"current_turn"`      // "X" or "O"
+	Status           string     `json:"status"`            // "waiting", "ready_check", "playing", "finished", "cancelled", "abandoned"
+	Winner           string     `json:"winner"`            // "X", "O", "draw", or ""
+	WinningLine      []int      `json:"winning_line"`      // indices of winning cells
+	LastMove         int        `json:"last_move"`         // index of last move, -1 before any move
+	LastMoveBy       string     `json:"last_move_by"`      // symbol that made the last move, or ""
+	Moves            []int      `json:"moves"`             // cell indices in the order they were played
+	Mode             string     `json:"mode"`              // "standard", or "practice": free undo, unscored
+	TotalSeconds     int        `json:"total_seconds"`     // per-player time budget, 0 for no clock
+	TimeLeftX        float64    `json:"time_left_x"`       // X's remaining seconds, excluding the running turn
+	TimeLeftO        float64    `json:"time_left_o"`       // O's remaining seconds, excluding the running turn
+	TurnStartedAt    time.Time  `json:"turn_started_at"`   // when the current turn began
+	TurnSeconds      int        `json:"turn_seconds"`      // per-turn limit, 0 for none
+	TimeoutPolicy    string     `json:"timeout_policy"`    // "forfeit" or "skip" when a turn times out
+	SkippedTurns     []TurnSkip `json:"skipped_turns"`     // turns passed by the skip policy
+	HintsDisabled    bool       `json:"hints_disabled"`    // refuse /api/game/hint, e.g. for ranked play
+	SymbolX          string     `json:"symbol_x"`          // marker shown for X; the board always holds "X"
+	SymbolO          string     `json:"symbol_o"`          // marker shown for O; the board always holds "O"
+	ConfirmMoves     bool       `json:"confirm_moves"`     // moves are held as pending until confirmed
+	ReadyCheck       bool       `json:"ready_check"`       // play starts only once both players call /api/game/ready
+	ReadyX           bool       `json:"ready_x"`           // X has confirmed the ready check
+	ReadyO           bool       `json:"ready_o"`           // O has confirmed the ready check
+	ReadyDeadline    time.Time  `json:"ready_deadline"`    // when an unconfirmed ready check cancels the game
+	Paused           bool       `json:"paused"`            // both players agreed to pause; moves and timers are stopped
+	PausedAt         time.Time  `json:"paused_at"`         // when the game was paused
+	PauseRequestBy   string     `json:"pause_request_by"`  // symbol asking to pause, or to resume if paused
+	ForfeitedBy      string     `json:"forfeited_by"`      // symbol that left or timed out, ending the game
+	ServerRestarting bool       `json:"server_restarting"` // the server is shutting down and the game will be lost
+	ShowEmote        bool       `json:"show_emote"`        // whether to show emote
+	EmoteType        string     `json:"emote_type"`        // type of emote (e.g., "deal_with_it")
+	EmoteBy          string     `json:"emote_by"`          // username who triggered it
+	EmoteAt          time.Time  `json:"emote_at"`          // when emote was triggered
+	CreatedAt        time.Time  `json:"created_at"`
+	StartedAt        time.Time  `json:"started_at"`    // when the second player joined
+	FinishedAt       time.Time  `json:"finished_at"`   // when the game ended
+	WinRevealAt      time.Time  `json:"win_reveal_at"` // when clients should move on from showing the winning line
+	UpdatedAt        time.Time  `json:"updated_at"`
+	Version          int        `json:"version"` // bumped on every change
+
+	history     []roomSnapshot  // recent versions, for state diffs
+	departed    map[string]bool // IDs of players who left after the game finished
+	pendingMove *int            // unconfirmed move by the player to move, with ConfirmMoves
+}
+
+// roomSnapshot is the diffable part of a room at one version
+type roomSnapshot struct {
+	Version     int
+	Board       []string
+	CurrentTurn string
+	Status      string
+	Winner      string
+}
+
+// finishedRetention is how long a finished room stays visible after a
+// player leaves it
+const finishedRetention = 30 * time.Second
+
+// readyCheckTimeout is how long both players have to confirm they are
+// ready before the game is cancelled
+const readyCheckTimeout = 30 * time.Second
+
+// idempotencyTTL is how long a create request's Idempotency-Key keeps
+// returning the room it first created
+const idempotencyTTL = 5 * time.Minute
+
+// diffHistory is how many versions back a state diff can reach before
+// falling back to the full state
+const diffHistory = 32
+
+// TurnSkip records a turn passed to the opponent after timing out
+type TurnSkip struct {
+	Symbol    string    `json:"symbol"`
+	At        time.Time `json:"at"`
+	AfterMove int       `json:"after_move"` // how many marks had been played, so undo can take it back
+}
+
+// gameStateResponse is a room as seen by a particular caller
+type gameStateResponse struct {
+	*GameRoom
+	YourSymbol  string     `json:"your_symbol"` // "X", "O", or "" for spectators
+	YourTurn    bool       `json:"your_turn"`
+	MoveCount   int        `json:"move_count"`
+	Duration    float64    `json:"duration_seconds"`       // from the start of play until it finished, or now
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`   // when a waiting room becomes eligible for cleanup
+	PendingMove *int       `json:"pending_move,omitempty"` // the caller's unconfirmed move, shown only to them
+	LegalMoves  []int      `json:"legal_moves,omitempty"`  // empty cells of a game in play, on request
+	Persisted   *bool      `json:"persisted,omitempty"`    // set on move responses
+	Warnings    []string   `json:"warnings,omitempty"`     // non-fatal notes on move responses
+}
+
+// stateDiff is what changed in a room since an earlier version. Full is
+// set instead of the other fields when that version is too old to diff.
+type stateDiff struct {
+	Version     int                `json:"version"`
+	Since       int                `json:"since_version"`
+	Cells       map[int]string     `json:"cells,omitempty"` // board index to symbol
+	CurrentTurn string             `json:"current_turn,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	Winner      string             `json:"winner,omitempty"`
+	WinningLine []int              `json:"winning_line,omitempty"`
+	Full        *gameStateResponse `json:"full,omitempty"`
+}
+
+// Warning codes included in move responses
+const (
+	warnDrawInevitable = "draw_inevitable" // no line can be completed by either player
+	warnLowTime        = "low_time"        // the mover has under lowTimeSeconds left
+)
+
+// lowTimeSeconds is the remaining clock below which a mover is warned
+const lowTimeSeconds = 10
+
+// Emote is an emote type players may trigger in a game
+type Emote struct {
+	Type  string `json:"type"`
+	Label string `json:"label"`
+	Image string `json:"image,omitempty"`
+}
+
+// emotes lists the emote types handleGameEmote accepts
+var emotes = []Emote{
+	{Type: "deal_with_it", Label: "Deal with it", Image: "images/deal-with-it.png"},
 }
 
 // GameStore manages active game rooms
@@ -66,65 +307,359 @@ type GameStore struct {
 	rooms map[string]*GameRoom // keyed by room ID
 	codes map[string]string    // code -> room ID
 	mu    sync.RWMutex
+
+	recent     []RecentGame // finished games, oldest first, at most recentGamesCap
+	restarting bool         // shutting down; no new games are started
+
+	// created maps a user ID and Idempotency-Key to the room that key
+	// created, so a retried create returns the same room
+	created map[idempotencyKey]createdRoom
+
+	// OnGameFinished, if set, receives each game's result as it ends. It
+	// is called with mu held, so it must not block or use the store.
+	OnGameFinished func(GameResult)
+}
+
+type idempotencyKey struct {
+	UserID string
+	Key    string
+}
+
+type createdRoom struct {
+	RoomID    string
+	CreatedAt time.Time
+}
+
+// RecentGame is a finished game as listed in the public feed, kept after
+// its room is cleaned up
+type RecentGame struct {
+	Code       string    `json:"code"`
+	BoardSize  int       `json:"board_size"`
+	PlayerX    string    `json:"player_x"` // usernames
+	PlayerO    string    `json:"player_o"`
+	Winner     string    `json:"winner"` // "X", "O", or "draw"
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// speedMinMoves is how many timed moves a player needs to be ranked on
+// the speed leaderboard, so a couple of quick moves can't top it
+const speedMinMoves = 10
+
+// recentGamesCap is how many finished games the feed retains
+const recentGamesCap = 100
+
+// GameResult is the structured record emitted when a game finishes
+type GameResult struct {
+	Code      string  `json:"code"`
+	BoardSize int     `json:"board_size"`
+	WinLength int     `json:"win_length"`
+	Mode      string  `json:"mode"`   // "timed", "untimed", or "practice"
+	Winner    string  `json:"winner"` // "X", "O", or "draw"
+	MoveCount int     `json:"move_count"`
+	Duration  float64 `json:"duration_seconds"`
 }
 
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
 var (
 	db       *Database
 	sessions *SessionStore
 	games    *GameStore
-	dbFile   = "users.json"
+	dataDir  = "." // directory holding all persisted files
+	store    Store // where users are persisted
+
+	// writeFile persists FileStore data; swappable to simulate disk failures
+	writeFile = os.WriteFile
+
+	maxGames = 0 // cap on unfinished rooms, 0 for unlimited
+
+	cleanupInterval = 5 * time.Minute // how often old rooms are swept
+	gameTTL         = time.Hour       // inactivity after which a room is removed
+
+	forfeitScoring = "loss" // how forfeits score: "loss", "forfeit", or "none"
+
+	shutdownGrace = 5 * time.Second // how long shutdown waits after flagging active games
+
+	winRevealDelay = 1500 * time.Millisecond // how long clients show a winning line before the result
+
+	blockedWords []string // lowercase substrings not allowed in usernames
+
+	maxSessions = 100000 // cap on logged-in sessions, 0 for unlimited
+
+	registration = "open" // "closed" refuses new accounts, including guests
+
+	prettyJSON = false // indent API responses, for reading them by hand
+
+	usernameMin = 2 // username length limits, in characters
+	usernameMax = 20
+
+	// leaderboardVersion is bumped whenever a score or the set of ranked
+	// users changes, so leaderboard clients can skip unchanged fetches
+	leaderboardVersion atomic.Int64
+
+	adminToken string // bearer token for /api/admin endpoints, empty to disable them
+
+	rateLimit = 300 // requests per minute per IP, 0 for unlimited; the web client polls twice a second
+	limiter   *ipLimiter
+
+	hintLimit   = 10 // hints per minute per user, 0 for unlimited
+	hintLimiter *ipLimiter
 )
 
 func main() {
+	flag.IntVar(&maxGames, "max-games", maxGames, "maximum number of active game rooms (0 for unlimited)")
+	flag.IntVar(&rateLimit, "rate-limit", rateLimit, "maximum requests per minute from one IP (0 for unlimited)")
+	flag.IntVar(&hintLimit, "hint-limit", hintLimit, "maximum hints and game analyses per minute for one user (0 for unlimited)")
+	flag.DurationVar(&cleanupInterval, "cleanup-interval", cleanupInterval, "how often to sweep inactive game rooms (minimum 10s)")
+	flag.DurationVar(&gameTTL, "game-ttl", gameTTL, "inactivity after which a game room is removed (minimum 1m)")
+	flag.StringVar(&forfeitScoring, "forfeit-scoring", forfeitScoring, "how a forfeit by leaving or timing out scores: loss, forfeit, or none")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", shutdownGrace, "on shutdown, how long to keep serving after telling players their games will end")
+	flag.DurationVar(&winRevealDelay, "win-reveal-delay", winRevealDelay, "how long after a winning move clients should reveal the result")
+	flag.StringVar(&dataDir, "data-dir", dataDir, "directory for persisted data files")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file (requires -tls-cert)")
+	autocertDomain := flag.String("autocert-domain", "", "domain to obtain a Let's Encrypt certificate for; serves on :443 and :80")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "token required by /api/admin endpoints (default $ADMIN_TOKEN; empty disables them)")
+	storeKind := flag.String("store", "json", "user store: json (users.json in -data-dir) or sqlite")
+	dbName := flag.String("db", "game.db", "SQLite database file for -store sqlite, relative to -data-dir")
+	flag.BoolVar(&prettyJSON, "pretty", prettyJSON, "indent JSON responses for readability (development)")
+	flag.StringVar(&registration, "registration", registration, "whether new accounts can be created: open or closed")
+	flag.IntVar(&maxSessions, "max-sessions", maxSessions, "maximum logged-in sessions; the least recently used is logged out beyond it (0 for unlimited)")
+	flag.IntVar(&usernameMin, "username-min", usernameMin, "minimum username length in characters")
+	flag.IntVar(&usernameMax, "username-max", usernameMax, "maximum username length in characters")
+	blocklistFile := flag.String("blocklist", "", "file of disallowed username substrings, one per line")
+	flag.Parse()
+
+	if cleanupInterval < 10*time.Second {
+		log.Fatal("-cleanup-interval must be at least 10s")
+	}
+	if gameTTL < time.Minute {
+		log.Fatal("-game-ttl must be at least 1m")
+	}
+
+	if usernameMin < 1 || usernameMax < usernameMin {
+		log.Fatal("-username-min must be at least 1 and no more than -username-max")
+	}
+
+	switch forfeitScoring {
+	case "loss", "forfeit", "none":
+	default:
+		log.Fatal("-forfeit-scoring must be loss, forfeit, or none")
+	}
+	if registration != "open" && registration != "closed" {
+		log.Fatal("-registration must be open or closed")
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+
+	if *blocklistFile != "" {
+		if err := loadBlocklist(*blocklistFile); err != nil {
+			log.Fatalf("Error loading blocklist: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Fatalf("Error creating data directory: %v", err)
+	}
+	switch *storeKind {
+	case "json":
+		store = &FileStore{path: filepath.Join(dataDir, "users.json")}
+	case "sqlite":
+		dbPath := *dbName
+		if !filepath.IsAbs(dbPath) {
+			dbPath = filepath.Join(dataDir, dbPath)
+			dataFiles = append(dataFiles, *dbName, *dbName+"-journal", *dbName+"-wal", *dbName+"-shm")
+		}
+		sqliteStore, err := openSQLiteStore(dbPath)
+		if err != nil {
+			log.Fatalf("Error opening database: %v", err)
+		}
+		store = sqliteStore
+	default:
+		log.Fatal("-store must be json or sqlite")
+	}
+
 	// Initialize database, sessions, and games
 	db = &Database{Users: make(map[string]*User)}
-	sessions = &SessionStore{sessions: make(map[string]string)}
+	sessions = &SessionStore{
+		sessions: make(map[string]*list.Element),
+		lru:      list.New(),
+		max:      maxSessions,
+
+		OnEnd: forgetGuest,
+	}
 	games = &GameStore{
 		rooms: make(map[string]*GameRoom),
 		codes: make(map[string]string),
+
+		created: make(map[idempotencyKey]createdRoom),
+
+		OnGameFinished: logGameResult,
 	}
 
 	// Load existing data
 	loadDatabase()
 
+	// Start leaderboard versions from the clock so a version seen before a
+	// restart never matches one issued after it
+	leaderboardVersion.Store(time.Now().UnixNano())
+
 	// Start cleanup routine for old games
 	go cleanupOldGames()
 
+	limiter = &ipLimiter{
+		limit:   rateLimit,
+		window:  time.Minute,
+		clients: make(map[string]*ipWindow),
+	}
+	go limiter.cleanup()
+
+	hintLimiter = &ipLimiter{
+		limit:   hintLimit,
+		window:  time.Minute,
+		clients: make(map[string]*ipWindow),
+	}
+	go hintLimiter.cleanup()
+
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/api/version", corsMiddleware(gzipMiddleware(handleVersion)))
+
 	// API routes - User management
-	http.HandleFunc("/api/register", corsMiddleware(handleRegister))
-	http.HandleFunc("/api/login", corsMiddleware(handleLogin))
-	http.HandleFunc("/api/logout", corsMiddleware(handleLogout))
-	http.HandleFunc("/api/user", corsMiddleware(handleGetUser))
-	http.HandleFunc("/api/score", corsMiddleware(handleUpdateScore))
-	http.HandleFunc("/api/leaderboard", corsMiddleware(handleLeaderboard))
+	http.HandleFunc("/api/register", corsMiddleware(gzipMiddleware(handleRegister)))
+	http.HandleFunc("/api/login", corsMiddleware(gzipMiddleware(handleLogin)))
+	http.HandleFunc("/api/guest", corsMiddleware(gzipMiddleware(handleGuest)))
+	http.HandleFunc("/api/logout", corsMiddleware(gzipMiddleware(handleLogout)))
+	http.HandleFunc("/api/user", corsMiddleware(gzipMiddleware(handleGetUser)))
+	http.HandleFunc("/api/score", corsMiddleware(gzipMiddleware(handleUpdateScore)))
+	http.HandleFunc("/api/user/reset-scores", corsMiddleware(gzipMiddleware(handleResetScores)))
+	http.HandleFunc("/api/user/preferences", corsMiddleware(gzipMiddleware(handlePreferences)))
+	http.HandleFunc("/api/user/export", corsMiddleware(gzipMiddleware(handleExportUser)))
+	http.HandleFunc("/api/leaderboard", corsMiddleware(gzipMiddleware(handleLeaderboard)))
 
 	// API routes - Multiplayer games
-	http.HandleFunc("/api/game/create", corsMiddleware(handleCreateGame))
-	http.HandleFunc("/api/game/join", corsMiddleware(handleJoinGame))
-	http.HandleFunc("/api/game/state", corsMiddleware(handleGameState))
-	http.HandleFunc("/api/game/move", corsMiddleware(handleGameMove))
-	http.HandleFunc("/api/game/leave", corsMiddleware(handleLeaveGame))
-	http.HandleFunc("/api/game/emote", corsMiddleware(handleGameEmote))
+	http.HandleFunc("/api/game/create", corsMiddleware(gzipMiddleware(handleCreateGame)))
+	http.HandleFunc("/api/game/join", corsMiddleware(gzipMiddleware(handleJoinGame)))
+	http.HandleFunc("/api/game/check", corsMiddleware(gzipMiddleware(handleCheckGame)))
+	http.HandleFunc("/api/game/state", corsMiddleware(gzipMiddleware(handleGameState)))
+	http.HandleFunc("/api/game/state-diff", corsMiddleware(gzipMiddleware(handleGameStateDiff)))
+	http.HandleFunc("/api/game/current", corsMiddleware(gzipMiddleware(handleCurrentGame)))
+	http.HandleFunc("/api/game/hint", corsMiddleware(gzipMiddleware(handleGameHint)))
+	http.HandleFunc("/api/game/threats", corsMiddleware(gzipMiddleware(handleGameThreats)))
+	http.HandleFunc("/api/game/analysis", corsMiddleware(gzipMiddleware(handleGameAnalysis)))
+	http.HandleFunc("/api/game/evaluate", corsMiddleware(gzipMiddleware(handleEvaluateMoves)))
+	http.HandleFunc("/api/game/move", corsMiddleware(gzipMiddleware(handleGameMove)))
+	http.HandleFunc("/api/game/confirm", corsMiddleware(gzipMiddleware(handleConfirmMove)))
+	http.HandleFunc("/api/game/undo", corsMiddleware(gzipMiddleware(handleUndoMove)))
+	http.HandleFunc("/api/game/leave", corsMiddleware(gzipMiddleware(handleLeaveGame)))
+	http.HandleFunc("/api/game/cancel", corsMiddleware(gzipMiddleware(handleCancelGame)))
+	http.HandleFunc("/api/game/new-code", corsMiddleware(gzipMiddleware(handleNewGameCode)))
+	http.HandleFunc("/api/game/transfer-host", corsMiddleware(gzipMiddleware(handleTransferHost)))
+	http.HandleFunc("/api/game/ready", corsMiddleware(gzipMiddleware(handleGameReady)))
+	http.HandleFunc("/api/game/pause", corsMiddleware(gzipMiddleware(handlePauseGame)))
+	http.HandleFunc("/api/game/resume", corsMiddleware(gzipMiddleware(handleResumeGame)))
+	http.HandleFunc("/api/game/emote", corsMiddleware(gzipMiddleware(handleGameEmote)))
+	http.HandleFunc("/api/game/emote-clear", corsMiddleware(gzipMiddleware(handleClearEmote)))
+	http.HandleFunc("/api/games/recent", corsMiddleware(gzipMiddleware(handleRecentGames)))
+	http.HandleFunc("/api/emotes", corsMiddleware(gzipMiddleware(handleListEmotes)))
+	http.HandleFunc("/api/game/export", corsMiddleware(gzipMiddleware(handleExportGame)))
+
+	// Admin routes
+	http.HandleFunc("/api/admin/games", corsMiddleware(gzipMiddleware(handleAdminGames)))
+	http.HandleFunc("/api/admin/games/{id}", corsMiddleware(gzipMiddleware(handleAdminDeleteGame)))
+
+	// Any other /api/ path is an API mistake, not a missing file
+	http.HandleFunc("/api/", corsMiddleware(handleUnknownAPI))
 
 	// Serve static files
 	fs := http.FileServer(http.Dir("."))
-	http.Handle("/", fs)
+	http.Handle("/", staticHandler(fs))
+
+	handler := requestIDMiddleware(rateLimitMiddleware(http.DefaultServeMux))
+
+	server := &http.Server{Addr: ":8080", Handler: handler}
+	serve := server.ListenAndServe
+	switch {
+	case *autocertDomain != "":
+		// Let's Encrypt needs the standard ports: :80 answers the HTTP-01
+		// challenge and redirects everything else to HTTPS
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(*autocertDomain),
+			Cache:      autocert.DirCache(filepath.Join(dataDir, "autocert")),
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(":80", manager.HTTPHandler(nil)))
+		}()
+
+		server.Addr = ":443"
+		server.TLSConfig = manager.TLSConfig()
+		serve = func() error { return server.ListenAndServeTLS("", "") }
+		fmt.Printf("Starting Tic Tac Toe web server on https://%s\n", *autocertDomain)
+	case *tlsCert != "":
+		serve = func() error { return server.ListenAndServeTLS(*tlsCert, *tlsKey) }
+		fmt.Printf("Starting Tic Tac Toe web server on https://localhost%s\n", server.Addr)
+		fmt.Println("Open your browser and navigate to the URL above to play!")
+	default:
+		fmt.Printf("Starting Tic Tac Toe web server on http://localhost%s\n", server.Addr)
+		fmt.Println("Open your browser and navigate to the URL above to play!")
+	}
 
-	port := "8080"
-	fmt.Printf("Starting Tic Tac Toe web server on http://localhost:%s\n", port)
-	fmt.Println("Open your browser and navigate to the URL above to play!")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve() }()
+
+	select {
+	case err := <-serveErr:
 		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	drainGames(shutdownGrace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
+}
+
+// drainGames flags every active room as restarting so polling clients can
+// tell their players, stops new games, and waits grace for in-flight moves
+func drainGames(grace time.Duration) {
+	games.mu.Lock()
+	games.restarting = true
+	now := time.Now().UTC()
+	count := 0
+	for _, room := range games.rooms {
+		if room.Status == "waiting" || room.Status == "ready_check" || room.Status == "playing" {
+			room.ServerRestarting = true
+			touchRoom(room, now)
+			count++
+		}
 	}
+	games.mu.Unlock()
+
+	log.Printf("Marked %d active games as restarting, waiting %v", count, grace)
+	time.Sleep(grace)
 }
 
 // corsMiddleware adds CORS headers
 func corsMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Leaderboard-Version")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -135,17 +670,203 @@ func corsMiddleware(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// ipLimiter caps requests per client IP over a sliding window, estimated
+// from the counts in the current and previous fixed windows
+type ipLimiter struct {
+	limit   int
+	window  time.Duration
+	clients map[string]*ipWindow
+	mu      sync.Mutex
+}
+
+// ipWindow counts one client's requests
+type ipWindow struct {
+	start     time.Time // start of the current fixed window
+	count     int       // requests in the current window
+	prevCount int       // requests in the window before it
+}
+
+// allow records a request from ip at now, reporting whether it is within
+// the limit
+func (l *ipLimiter) allow(ip string, now time.Time) bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client := l.clients[ip]
+	if client == nil {
+		client = &ipWindow{start: now}
+		l.clients[ip] = client
+	}
+
+	// Roll forward to the window containing now
+	if elapsed := now.Sub(client.start); elapsed >= l.window {
+		if elapsed < 2*l.window {
+			client.prevCount = client.count
+		} else {
+			client.prevCount = 0
+		}
+		client.count = 0
+		client.start = client.start.Add(elapsed.Truncate(l.window))
+	}
+
+	// Weight the previous window by how much of it still overlaps
+	overlap := 1 - float64(now.Sub(client.start))/float64(l.window)
+	if float64(client.prevCount)*overlap+float64(client.count) >= float64(l.limit) {
+		return false
+	}
+	client.count++
+	return true
+}
+
+// cleanup periodically forgets clients idle for over two windows so the
+// map stays bounded
+func (l *ipLimiter) cleanup() {
+	ticker := time.NewTicker(l.window)
+	for range ticker.C {
+		l.mu.Lock()
+		now := time.Now().UTC()
+		for ip, client := range l.clients {
+			if now.Sub(client.start) > 2*l.window {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimitMiddleware rejects clients over the per-IP request limit with
+// 429. Health checks are exempt.
+func rateLimitMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" && !limiter.allow(clientIP(r), time.Now().UTC()) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(limiter.window.Seconds())))
+			jsonErrorCode(w, "rate_limited", "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address of the request's remote peer
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// gzipMinSize is the smallest response body worth compressing
+const gzipMinSize = 1024
+
+// gzipResponseWriter buffers a response so gzipMiddleware can decide
+// whether to compress it once the handler is done
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	g.status = status
+}
+
+func (g *gzipResponseWriter) Write(data []byte) (int, error) {
+	return g.buf.Write(data)
+}
+
+// gzipMiddleware compresses responses for clients that accept gzip,
+// leaving bodies under gzipMinSize as they are
+func gzipMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			handler(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(gw, r)
+
+		if gw.buf.Len() < gzipMinSize {
+			w.WriteHeader(gw.status)
+			w.Write(gw.buf.Bytes())
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(gw.status)
+		zw := gzip.NewWriter(w)
+		zw.Write(gw.buf.Bytes())
+		zw.Close()
+	}
+}
+
+// contextKey namespaces values stored in a request context
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+// requestIDMiddleware tags each request with the client's X-Request-ID, or a
+// generated one, and echoes it back in the response
+func requestIDMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = generateID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID accepts short IDs of printable ASCII so client-supplied
+// values can't forge extra log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID assigned to a request by requestIDMiddleware
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// logf logs a message prefixed with the request's ID
+func logf(r *http.Request, format string, args ...interface{}) {
+	log.Printf("[%s] "+format, append([]interface{}{requestID(r)}, args...)...)
+}
+
+// randReader supplies the randomness for IDs, tokens, and game codes;
+// swappable for a deterministic source in tests
+var randReader io.Reader = rand.Reader
+
 // generateID creates a unique ID
 func generateID() string {
 	bytes := make([]byte, 16)
-	rand.Read(bytes)
+	io.ReadFull(randReader, bytes)
 	return hex.EncodeToString(bytes)
 }
 
 // generateToken creates a session token
 func generateToken() string {
 	bytes := make([]byte, 32)
-	rand.Read(bytes)
+	io.ReadFull(randReader, bytes)
 	return hex.EncodeToString(bytes)
 }
 
@@ -153,7 +874,7 @@ func generateToken() string {
 func generateGameCode() string {
 	const chars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // Removed confusing chars
 	bytes := make([]byte, 6)
-	rand.Read(bytes)
+	io.ReadFull(randReader, bytes)
 	code := make([]byte, 6)
 	for i := range code {
 		code[i] = chars[int(bytes[i])%len(chars)]
@@ -161,103 +882,530 @@ func generateGameCode() string {
 	return string(code)
 }
 
-// loadDatabase reads users from JSON file
-func loadDatabase() {
-	data, err := os.ReadFile(dbFile)
+// uniqueGameCode returns a game code not used by any room. The caller
+// must hold games.mu.
+func uniqueGameCode() string {
+	for {
+		code := generateGameCode()
+		if _, exists := games.codes[code]; !exists {
+			return code
+		}
+	}
+}
+
+// Store persists users between restarts
+type Store interface {
+	// LoadUsers returns every persisted user, keyed by ID
+	LoadUsers() (map[string]*User, error)
+	// SaveUsers inserts or updates the given users all at once: either
+	// every change is persisted or none is
+	SaveUsers(users ...*User) error
+}
+
+// FileStore is a Store keeping all users in a single JSON file, which is
+// rewritten in full on every save
+type FileStore struct {
+	path  string
+	mu    sync.Mutex
+	users map[string]*User // everything in the file, keyed by ID
+}
+
+// LoadUsers reads the JSON file; a missing file holds no users
+func (fs *FileStore) LoadUsers() (map[string]*User, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.users = make(map[string]*User)
+	data, err := os.ReadFile(fs.path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Println("No existing database, starting fresh")
-			return
+			return map[string]*User{}, nil
 		}
-		log.Printf("Error reading database: %v", err)
-		return
+		return nil, err
 	}
 
-	if err := json.Unmarshal(data, db); err != nil {
-		log.Printf("Error parsing database: %v", err)
+	var saved Database
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
 	}
-
-	if db.Users == nil {
-		db.Users = make(map[string]*User)
+	users := make(map[string]*User, len(saved.Users))
+	for id, user := range saved.Users {
+		fs.users[id] = user
+		users[id] = user
 	}
-
-	log.Printf("Loaded %d users from database", len(db.Users))
+	return users, nil
 }
 
-// saveDatabase writes users to JSON file
-func saveDatabase() error {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// SaveUsers merges users into the file's contents and rewrites it. The
+// new contents go to a temporary file that replaces the old one, so a
+// failed write leaves the previous file intact.
+func (fs *FileStore) SaveUsers(users ...*User) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.users == nil {
+		fs.users = make(map[string]*User)
+	}
+	for _, user := range users {
+		fs.users[user.ID] = user
+	}
 
-	data, err := json.MarshalIndent(db, "", "  ")
+	data, err := json.MarshalIndent(&Database{Users: fs.users}, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(dbFile, data, 0644)
+	tmp := fs.path + ".tmp"
+	if err := writeFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fs.path)
 }
 
-// findUserByUsername finds a user by username
-func findUserByUsername(username string) *User {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// SQLiteStore is a Store backed by a SQLite database, updating only the
+// users that changed
+type SQLiteStore struct {
+	conn *sql.DB
+}
 
-	for _, user := range db.Users {
-		if user.Username == username {
-			return user
-		}
-	}
-	return nil
+// sqliteMigrations are applied in order, each bumping PRAGMA user_version
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		id          TEXT PRIMARY KEY,
+		username    TEXT NOT NULL UNIQUE,
+		wins        INTEGER NOT NULL DEFAULT 0,
+		losses      INTEGER NOT NULL DEFAULT 0,
+		draws       INTEGER NOT NULL DEFAULT 0,
+		size_scores TEXT NOT NULL DEFAULT '{}',
+		created_at  TEXT NOT NULL
+	)`,
+	`ALTER TABLE users ADD COLUMN preferences TEXT NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE users ADD COLUMN forfeits INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN move_seconds REAL NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN timed_moves INTEGER NOT NULL DEFAULT 0`,
 }
 
-// getUserFromToken gets user from session token
-func getUserFromToken(r *http.Request) *User {
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		return nil
+// openSQLiteStore opens the database at path, creating it and bringing
+// its schema up to date as needed
+func openSQLiteStore(path string) (*SQLiteStore, error) {
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
 	}
+	// One connection serializes writers, avoiding SQLITE_BUSY
+	conn.SetMaxOpenConns(1)
 
-	sessions.mu.RLock()
-	userID, exists := sessions.sessions[token]
-	sessions.mu.RUnlock()
-
-	if !exists {
-		return nil
+	var current int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for i := current; i < len(sqliteMigrations); i++ {
+		if _, err := conn.Exec(sqliteMigrations[i]); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := conn.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		log.Printf("Applied database migration %d", i+1)
 	}
 
-	db.mu.RLock()
-	user := db.Users[userID]
-	db.mu.RUnlock()
-
-	return user
+	return &SQLiteStore{conn: conn}, nil
 }
 
-// cleanupOldGames removes games older than 1 hour
-func cleanupOldGames() {
-	ticker := time.NewTicker(5 * time.Minute)
-	for range ticker.C {
-		games.mu.Lock()
-		now := time.Now()
-		for id, room := range games.rooms {
-			if now.Sub(room.UpdatedAt) > time.Hour {
-				delete(games.codes, room.Code)
-				delete(games.rooms, id)
-				log.Printf("Cleaned up old game room: %s", room.Code)
-			}
+// LoadUsers reads every row of the users table
+func (ss *SQLiteStore) LoadUsers() (map[string]*User, error) {
+	rows, err := ss.conn.Query("SELECT id, username, wins, losses, draws, forfeits, size_scores, preferences, created_at, move_seconds, timed_moves FROM users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]*User)
+	for rows.Next() {
+		var user User
+		var sizeScores, preferences, createdAt string
+		if err := rows.Scan(&user.ID, &user.Username, &user.Scores.Wins, &user.Scores.Losses, &user.Scores.Draws, &user.Scores.Forfeits, &sizeScores, &preferences, &createdAt, &user.MoveSeconds, &user.TimedMoves); err != nil {
+			return nil, err
 		}
-		games.mu.Unlock()
+		if user.TimedMoves > 0 {
+			user.AvgMoveSeconds = user.MoveSeconds / float64(user.TimedMoves)
+		}
+		if err := json.Unmarshal([]byte(sizeScores), &user.SizeScores); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.ID, err)
+		}
+		if len(user.SizeScores) == 0 {
+			user.SizeScores = nil
+		}
+		if err := json.Unmarshal([]byte(preferences), &user.Preferences); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.ID, err)
+		}
+		if len(user.Preferences) == 0 {
+			user.Preferences = nil
+		}
+		if user.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.ID, err)
+		}
+		users[user.ID] = &user
 	}
+	return users, rows.Err()
 }
 
-// generateWinningConditions creates all winning line combinations
-func generateWinningConditions(size int) [][]int {
-	winLen := 3
-	if size == 5 {
-		winLen = 4
+// SaveUsers upserts the given users in a single transaction
+func (ss *SQLiteStore) SaveUsers(users ...*User) error {
+	tx, err := ss.conn.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
+	for _, user := range users {
+		sizeScores, err := json.Marshal(user.SizeScores)
+		if err != nil {
+			return err
+		}
+		if user.SizeScores == nil {
+			sizeScores = []byte("{}")
+		}
+		preferences, err := json.Marshal(user.Preferences)
+		if err != nil {
+			return err
+		}
+		if user.Preferences == nil {
+			preferences = []byte("{}")
+		}
+		_, err = tx.Exec(`INSERT INTO users (id, username, wins, losses, draws, forfeits, size_scores, preferences, created_at, move_seconds, timed_moves)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				username = excluded.username,
+				wins = excluded.wins,
+				losses = excluded.losses,
+				draws = excluded.draws,
+				forfeits = excluded.forfeits,
+				size_scores = excluded.size_scores,
+				preferences = excluded.preferences,
+				move_seconds = excluded.move_seconds,
+				timed_moves = excluded.timed_moves`,
+			user.ID, user.Username, user.Scores.Wins, user.Scores.Losses, user.Scores.Draws, user.Scores.Forfeits,
+			string(sizeScores), string(preferences), user.CreatedAt.UTC().Format(time.RFC3339Nano),
+			user.MoveSeconds, user.TimedMoves)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// loadDatabase reads users from the store
+func loadDatabase() {
+	users, err := store.LoadUsers()
+	if err != nil {
+		log.Printf("Error loading database: %v", err)
+		return
+	}
+	if len(users) == 0 {
+		log.Println("No existing users, starting fresh")
+	}
+
+	// Normalize timestamps written by older versions in server local time
+	for _, user := range users {
+		user.CreatedAt = user.CreatedAt.UTC()
+	}
+	db.Users = users
+
+	log.Printf("Loaded %d users from database", len(db.Users))
+}
+
+// saveUsers writes the given users to the store. Guests are skipped, and
+// nil users are ignored so callers can pass both seats of a room.
+func saveUsers(users ...*User) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var saved []*User
+	for _, user := range users {
+		if user != nil && !user.Guest {
+			saved = append(saved, user)
+		}
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+
+	return store.SaveUsers(saved...)
+}
+
+// persistResult saves the scores from a finished game, reporting whether
+// the save succeeded. Both players are saved in one batch, so one's
+// change is never persisted without the other's. A failure is logged
+// loudly since scores are lost on restart.
+func persistResult(room *GameRoom) bool {
+	if err := saveUsers(room.PlayerX, room.PlayerO); err != nil {
+		log.Printf("ERROR: game %s result was not persisted: %v", room.Code, err)
+		return false
+	}
+	return true
+}
+
+// loadBlocklist reads disallowed username substrings from a file, one per
+// line. Blank lines and lines starting with # are ignored.
+func loadBlocklist(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		word := strings.ToLower(strings.TrimSpace(line))
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		blockedWords = append(blockedWords, word)
+	}
+
+	log.Printf("Loaded %d blocked username words", len(blockedWords))
+	return nil
+}
+
+// reservedUsernames may not be registered, to avoid impersonating the
+// server or its staff; matched case-insensitively
+var reservedUsernames = []string{"admin", "administrator", "moderator", "system", "server", "bot"}
+
+// reservedUsernamePrefixes may not start a registered username. Guest
+// accounts are named "Guest-XXXX".
+var reservedUsernamePrefixes = []string{"guest"}
+
+// isUsernameReserved reports whether a username is reserved
+func isUsernameReserved(username string) bool {
+	lower := strings.ToLower(username)
+	for _, name := range reservedUsernames {
+		if lower == name {
+			return true
+		}
+	}
+	for _, prefix := range reservedUsernamePrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUsernameBlocked reports whether a username contains a blocked substring
+func isUsernameBlocked(username string) bool {
+	lower := strings.ToLower(username)
+	for _, word := range blockedWords {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// findUserByUsername finds a user by username
+func findUserByUsername(username string) *User {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, user := range db.Users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+var errMalformedAuth = errors.New("malformed Authorization header")
+
+// parseAuthToken extracts the session token from an Authorization header,
+// accepting either a bare token or "Bearer <token>". An empty header
+// yields an empty token.
+func parseAuthToken(header string) (string, error) {
+	parts := strings.Fields(header)
+	switch {
+	case len(parts) == 0:
+		return "", nil
+	case len(parts) == 1 && !strings.EqualFold(parts[0], "Bearer"):
+		return parts[0], nil
+	case len(parts) == 2 && strings.EqualFold(parts[0], "Bearer"):
+		return parts[1], nil
+	}
+	return "", errMalformedAuth
+}
+
+// requireAdmin checks the request carries the admin token, writing a 403
+// if not. Admin endpoints are always refused when no token is configured.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token, err := parseAuthToken(r.Header.Get("Authorization"))
+	if err != nil || adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		jsonError(w, "Admin access required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// getUserFromToken gets user from session token
+func getUserFromToken(r *http.Request) *User {
+	token, err := parseAuthToken(r.Header.Get("Authorization"))
+	if err != nil || token == "" {
+		return nil
+	}
+
+	userID, exists := sessions.lookup(token)
+
+	if !exists {
+		return nil
+	}
+
+	db.mu.RLock()
+	user := db.Users[userID]
+	db.mu.RUnlock()
+
+	return user
+}
+
+// requireUser returns the authenticated user, or writes a 401 and returns
+// nil if the request has no valid session
+func requireUser(w http.ResponseWriter, r *http.Request) *User {
+	if _, err := parseAuthToken(r.Header.Get("Authorization")); err != nil {
+		jsonError(w, "Malformed Authorization header, expected a bare or Bearer token", http.StatusUnauthorized)
+		return nil
+	}
+
+	user := getUserFromToken(r)
+	if user == nil {
+		jsonError(w, "Not authenticated", http.StatusUnauthorized)
+	}
+	return user
+}
+
+// cleanupOldGames periodically removes games inactive for longer than gameTTL
+func cleanupOldGames() {
+	ticker := time.NewTicker(cleanupInterval)
+	for range ticker.C {
+		sweepOldGames(time.Now().UTC())
+		sweepGuests(time.Now().UTC())
+	}
+}
+
+// guestTTL is how long a guest account lasts, even if its session is
+// never ended
+const guestTTL = 24 * time.Hour
+
+// forgetGuest deletes a guest account once its session has ended. Guests
+// can't log back in, so the account would otherwise never be freed.
+func forgetGuest(userID string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if user := db.Users[userID]; user != nil && user.Guest {
+		delete(db.Users, userID)
+	}
+}
+
+// sweepGuests logs out and deletes guest accounts older than guestTTL as
+// of now
+func sweepGuests(now time.Time) {
+	var expired []string
+	db.mu.RLock()
+	for id, user := range db.Users {
+		if user.Guest && now.Sub(user.CreatedAt) > guestTTL {
+			expired = append(expired, id)
+		}
+	}
+	db.mu.RUnlock()
+
+	for _, id := range expired {
+		sessions.removeUser(id)
+		forgetGuest(id)
+	}
+}
+
+// sweepOldGames removes rooms that have been inactive for longer than
+// gameTTL as of now
+func sweepOldGames(now time.Time) {
+	games.mu.Lock()
+	defer games.mu.Unlock()
+
+	for key, entry := range games.created {
+		if now.Sub(entry.CreatedAt) > idempotencyTTL {
+			delete(games.created, key)
+		}
+	}
+
+	for id, room := range games.rooms {
+		expireReadyCheck(room)
+		done := room.Status == "cancelled" || room.Status == "abandoned" ||
+			(room.Status == "finished" && len(room.departed) > 0)
+		if done && now.Sub(room.FinishedAt) > finishedRetention {
+			delete(games.codes, room.Code)
+			delete(games.rooms, id)
+			continue
+		}
+		if now.Sub(room.UpdatedAt) > gameTTL {
+			// A game still in progress ends with no result rather
+			// than counting as finished. The room is kept like a
+			// finished one so polling players see why it ended.
+			if room.Status == "playing" {
+				room.Status = "abandoned"
+				room.FinishedAt = now
+				touchRoom(room, now)
+				log.Printf("Game %s: abandoned mid-game (board %v)", room.Code, room.Board)
+				continue
+			}
+			delete(games.codes, room.Code)
+			delete(games.rooms, id)
+			log.Printf("Cleaned up old game room: %s", room.Code)
+		}
+	}
+}
+
+// activeRoomCount counts rooms that have not ended. The caller must hold games.mu.
+func activeRoomCount() int {
+	count := 0
+	for _, room := range games.rooms {
+		if room.Status != "finished" && room.Status != "cancelled" && room.Status != "abandoned" {
+			count++
+		}
+	}
+	return count
+}
+
+// defaultWinLengths maps each supported board size to the number of marks
+// in a row needed to win when a game doesn't specify one
+var defaultWinLengths = map[int]int{
+	3: 3,
+	4: 3,
+	5: 4,
+	6: 4,
+	7: 4,
+}
+
+// defaultWinLength returns the default win length for a board size, or 0
+// if the size isn't supported
+func defaultWinLength(size int) int {
+	return defaultWinLengths[size]
+}
+
+// generateWinningConditions creates all winning line combinations.
+// A winLen of 0 selects the default for the board size.
+func generateWinningConditions(size, winLen int) [][]int {
+	if winLen == 0 {
+		winLen = defaultWinLength(size)
+	}
+
+	// A line must fit on the board; this also keeps every generated index
+	// within 0..size*size-1 on any board, odd or even
+	if size < 1 || winLen < 1 || winLen > size {
+		return nil
+	}
+
+	var conditions [][]int
 
-	var conditions [][]int
-
 	// Rows
 	for row := 0; row < size; row++ {
 		for startCol := 0; startCol <= size-winLen; startCol++ {
@@ -291,7 +1439,8 @@ func generateWinningConditions(size int) [][]int {
 		}
 	}
 
-	// Diagonals (top-right to bottom-left)
+	// Diagonals (top-right to bottom-left); starting columns begin at
+	// winLen-1 so the line never steps past column 0
 	for row := 0; row <= size-winLen; row++ {
 		for col := winLen - 1; col < size; col++ {
 			condition := make([]int, winLen)
@@ -302,431 +1451,3062 @@ func generateWinningConditions(size int) [][]int {
 		}
 	}
 
-	return conditions
-}
+	return conditions
+}
+
+// generatePatternConditions returns the lines of generateWinningConditions
+// plus the extra shapes a win pattern allows: "square" adds every 2x2
+// block and "corners" adds the board's four corners.
+func generatePatternConditions(pattern string, size, winLen int) [][]int {
+	conditions := generateWinningConditions(size, winLen)
+	if size < 2 {
+		return conditions
+	}
+
+	switch pattern {
+	case "square":
+		for row := 0; row < size-1; row++ {
+			for col := 0; col < size-1; col++ {
+				top := row*size + col
+				conditions = append(conditions, []int{top, top + 1, top + size, top + size + 1})
+			}
+		}
+	case "corners":
+		conditions = append(conditions, []int{0, size - 1, size * (size - 1), size*size - 1})
+	}
+	return conditions
+}
+
+// winConditions returns every set of cells that wins in the room
+func winConditions(room *GameRoom) [][]int {
+	return generatePatternConditions(room.WinPattern, room.BoardSize, room.WinLength)
+}
+
+// searcher finds moves by alpha-beta search over a board. Large boards
+// are searched to a limited depth and scored heuristically beyond it.
+type searcher struct {
+	board     []string
+	size      int
+	lines     [][]int
+	cellLines [][]int // indices into lines passing through each cell
+	order     []int   // cells nearest the center first, for better pruning
+}
+
+// Search scores: a win outweighs any heuristic score, and a sooner win
+// outweighs a later one
+const (
+	searchWin      = 1_000_000
+	searchMaxDepth = 9
+)
+
+func newSearcher(board []string, size int, lines [][]int) *searcher {
+	s := &searcher{
+		board:     append([]string(nil), board...),
+		size:      size,
+		lines:     lines,
+		cellLines: make([][]int, len(board)),
+	}
+	for i, line := range s.lines {
+		for _, idx := range line {
+			s.cellLines[idx] = append(s.cellLines[idx], i)
+		}
+	}
+
+	center := float64(size-1) / 2
+	dist := func(idx int) float64 {
+		row, col := indexToRowCol(idx, size)
+		return math.Abs(float64(row)-center) + math.Abs(float64(col)-center)
+	}
+	for i := range board {
+		s.order = append(s.order, i)
+	}
+	sort.SliceStable(s.order, func(a, b int) bool {
+		return dist(s.order[a]) < dist(s.order[b])
+	})
+	return s
+}
+
+// bestMove returns the best cell for symbol to play, or -1 if the board
+// is full
+func (s *searcher) bestMove(symbol string) int {
+	best, _ := s.search(symbol)
+	return best
+}
+
+// emptyCells counts the cells still open
+func (s *searcher) emptyCells() int {
+	empty := 0
+	for _, cell := range s.board {
+		if cell == "" {
+			empty++
+		}
+	}
+	return empty
+}
+
+// depth returns how many plies to search from the current board, keeping
+// the search to roughly the same work on every board size
+func (s *searcher) depth() int {
+	empty := s.emptyCells()
+	switch {
+	case empty > 25:
+		return 2
+	case empty > 12:
+		return 4
+	}
+	return searchMaxDepth
+}
+
+// exhaustive reports whether a search from the current board reaches
+// every possible ending, so its scores are exact rather than heuristic
+func (s *searcher) exhaustive() bool {
+	return s.depth() >= s.emptyCells()
+}
+
+// search returns the best cell for symbol to play and its score, or -1
+// if the board is full
+func (s *searcher) search(symbol string) (int, int) {
+	depth := s.depth()
+	best, bestScore := -1, math.MinInt
+	alpha := -searchWin * 2
+	for _, idx := range s.order {
+		if s.board[idx] != "" {
+			continue
+		}
+		s.board[idx] = symbol
+		score := -s.negamax(otherSymbol(symbol), idx, depth-1, -searchWin*2, -alpha)
+		s.board[idx] = ""
+		if score > bestScore {
+			best, bestScore = idx, score
+		}
+		alpha = max(alpha, score)
+	}
+	return best, bestScore
+}
+
+// scoreMove returns the score of symbol playing idx, searched with a full
+// window so it is comparable with the best move's score
+func (s *searcher) scoreMove(symbol string, idx int) int {
+	depth := s.depth()
+	s.board[idx] = symbol
+	score := -s.negamax(otherSymbol(symbol), idx, depth-1, -searchWin*2, searchWin*2)
+	s.board[idx] = ""
+	return score
+}
+
+// searchOutcome names what a search score means for the player who moved:
+// "win" or "loss" when forced, "draw" when neither is and the search was
+// exhaustive, and "unclear" otherwise
+func searchOutcome(score int, exhaustive bool) string {
+	switch {
+	case score >= searchWin:
+		return "win"
+	case score <= -searchWin:
+		return "loss"
+	case exhaustive:
+		return "draw"
+	}
+	return "unclear"
+}
+
+// outcomeRank orders outcomes from the mover's point of view
+var outcomeRank = map[string]int{"loss": 0, "unclear": 1, "draw": 1, "win": 2}
+
+// negamax scores the board for toMove, whose opponent just played last
+func (s *searcher) negamax(toMove string, last, depth, alpha, beta int) int {
+	if s.completesLine(last) {
+		return -(searchWin + depth)
+	}
+	if depth == 0 {
+		return s.evaluate(toMove)
+	}
+
+	moved := false
+	for _, idx := range s.order {
+		if s.board[idx] != "" {
+			continue
+		}
+		moved = true
+		s.board[idx] = toMove
+		score := -s.negamax(otherSymbol(toMove), idx, depth-1, -beta, -alpha)
+		s.board[idx] = ""
+		if score >= beta {
+			return score
+		}
+		alpha = max(alpha, score)
+	}
+	if !moved {
+		return 0 // draw
+	}
+	return alpha
+}
+
+// completesLine reports whether the mark at idx finished a line
+func (s *searcher) completesLine(idx int) bool {
+	symbol := s.board[idx]
+	for _, li := range s.cellLines[idx] {
+		complete := true
+		for _, cell := range s.lines[li] {
+			if s.board[cell] != symbol {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate scores an unfinished position for symbol: each line still
+// open to only one player counts for that player, more so the fuller it is
+func (s *searcher) evaluate(symbol string) int {
+	score := 0
+	for _, line := range s.lines {
+		mine, theirs := 0, 0
+		for _, idx := range line {
+			switch s.board[idx] {
+			case "":
+			case symbol:
+				mine++
+			default:
+				theirs++
+			}
+		}
+		switch {
+		case theirs == 0 && mine > 0:
+			score += 1 << (2 * mine)
+		case mine == 0 && theirs > 0:
+			score -= 1 << (2 * theirs)
+		}
+	}
+	return score
+}
+
+// winningCells returns the empty cells, in order, that would complete one
+// of the conditions for symbol if played now
+func winningCells(board []string, conditions [][]int, symbol string) []int {
+	found := map[int]bool{}
+	for _, condition := range conditions {
+		empty, marks := -1, 0
+		for _, idx := range condition {
+			switch board[idx] {
+			case symbol:
+				marks++
+			case "":
+				empty = idx
+			}
+		}
+		if marks == len(condition)-1 && empty >= 0 {
+			found[empty] = true
+		}
+	}
+
+	cells := []int{}
+	for idx := range board {
+		if found[idx] {
+			cells = append(cells, idx)
+		}
+	}
+	return cells
+}
+
+// boardMatchesSize reports whether the room's board has one cell per
+// square of its board size
+func boardMatchesSize(room *GameRoom) bool {
+	return room.BoardSize > 0 && len(room.Board) == room.BoardSize*room.BoardSize
+}
+
+// validateRoom checks that a room's board could have come from legal
+// play. Turns alternate starting with X, each either marking a cell or
+// being skipped, so X has taken as many turns as O or one more; and at
+// most one player can have a line.
+func validateRoom(room *GameRoom) error {
+	if !boardMatchesSize(room) {
+		return fmt.Errorf("board has %d cells, want %d", len(room.Board), room.BoardSize*room.BoardSize)
+	}
+
+	turns := map[string]int{}
+	for i, cell := range room.Board {
+		switch cell {
+		case "":
+		case "X", "O":
+			turns[cell]++
+		default:
+			return fmt.Errorf("cell %d holds unknown symbol %q", i, cell)
+		}
+	}
+	for _, skip := range room.SkippedTurns {
+		turns[skip.Symbol]++
+	}
+	if diff := turns["X"] - turns["O"]; diff < 0 || diff > 1 {
+		return fmt.Errorf("X has taken %d turns and O %d", turns["X"], turns["O"])
+	}
+
+	lines := map[string]bool{}
+	for _, condition := range winConditions(room) {
+		first := room.Board[condition[0]]
+		if first == "" {
+			continue
+		}
+		complete := true
+		for _, idx := range condition[1:] {
+			if room.Board[idx] != first {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			lines[first] = true
+		}
+	}
+	if lines["X"] && lines["O"] {
+		return errors.New("both players have a winning line")
+	}
+	return nil
+}
+
+// checkWinner checks if any of the winning conditions is complete
+func checkWinner(board []string, conditions [][]int) (string, []int) {
+	for _, condition := range conditions {
+		first := board[condition[0]]
+		if first == "" {
+			continue
+		}
+
+		won := true
+		for _, idx := range condition {
+			if board[idx] != first {
+				won = false
+				break
+			}
+		}
+
+		if won {
+			return first, condition
+		}
+	}
+
+	return "", nil
+}
+
+// checkDraw checks if the game is a draw
+func checkDraw(board []string) bool {
+	for _, cell := range board {
+		if cell == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// MoveError describes why a move was rejected by applyMove
+type MoveError struct {
+	Code    string
+	Message string
+}
+
+func (e *MoveError) Error() string {
+	return e.Message
+}
+
+var (
+	errGameNotInProgress  = &MoveError{"game_not_in_progress", "Game is not in progress"}
+	errGameOver           = &MoveError{"game_over", "Game is over"}
+	errWaitingForOpponent = &MoveError{"waiting_for_opponent", "Waiting for an opponent to join"}
+	errWaitingForReady    = &MoveError{"waiting_for_ready", "Waiting for both players to be ready"}
+	errNotInGame          = &MoveError{"not_in_game", "You are not in this game"}
+	errNotYourTurn        = &MoveError{"not_your_turn", "Not your turn"}
+	errInvalidPosition    = &MoveError{"invalid_position", "Invalid move position"}
+	errCellTaken          = &MoveError{"cell_taken", "Cell already taken"}
+	errTimeExpired        = &MoveError{"time_expired", "Time expired"}
+	errCorruptRoom        = &MoveError{"invalid_room_state", "Game state is invalid"}
+	errBoardMisconfigured = &MoveError{"board_misconfigured", "Game board does not match its size"}
+	errMissingPlayer      = &MoveError{"missing_player", "Game does not have two players"}
+	errSamePlayer         = &MoveError{"same_player", "One player holds both seats"}
+	errGamePaused         = &MoveError{"game_paused", "Game is paused"}
+)
+
+// notPlayingError explains why a room that isn't being played refuses
+// moves, so clients can tell a finished game from one not yet started
+func notPlayingError(room *GameRoom) *MoveError {
+	switch room.Status {
+	case "finished":
+		return errGameOver
+	case "waiting":
+		return errWaitingForOpponent
+	case "ready_check":
+		return errWaitingForReady
+	}
+	return errGameNotInProgress
+}
+
+// playerSymbol returns the symbol the user plays in the room, or ""
+func playerSymbol(room *GameRoom, userID string) string {
+	if room.PlayerX != nil && room.PlayerX.ID == userID {
+		return "X"
+	}
+	if room.PlayerO != nil && room.PlayerO.ID == userID {
+		return "O"
+	}
+	return ""
+}
+
+// applyMove validates a move by the given user and applies it to the room,
+// switching turns or finishing the game. The caller must hold games.mu.
+func applyMove(room *GameRoom, userID string, index int) error {
+	symbol, err := checkMove(room, userID, index)
+	if err != nil {
+		return err
+	}
+
+	// Make the move
+	now := time.Now().UTC()
+	elapsed := now.Sub(room.TurnStartedAt).Seconds()
+	if room.TotalSeconds > 0 {
+		if symbol == "X" {
+			room.TimeLeftX -= elapsed
+		} else {
+			room.TimeLeftO -= elapsed
+		}
+	}
+	if room.Mode != "practice" {
+		mover := room.PlayerX
+		if symbol == "O" {
+			mover = room.PlayerO
+		}
+		addMoveTime(mover, elapsed)
+	}
+	room.Board[index] = symbol
+	room.pendingMove = nil
+	room.LastMove = index
+	room.LastMoveBy = symbol
+	room.Moves = append(room.Moves, index)
+	room.TurnStartedAt = now
+
+	// Check for winner. The room is touched once the turn has passed or
+	// the game has finished, so its snapshot for diffs is complete.
+	winner, winningLine := checkWinner(room.Board, winConditions(room))
+	if winner != "" {
+		room.WinningLine = winningLine
+		finishGame(room, winner)
+	} else if checkDraw(room.Board) {
+		finishGame(room, "draw")
+	} else {
+		// Switch turns
+		room.CurrentTurn = otherSymbol(room.CurrentTurn)
+		touchRoom(room, now)
+	}
+
+	return nil
+}
+
+// proposeMove validates a move and holds it as the player's pending move
+// until they confirm it, replacing any earlier pending move. It is used
+// in rooms with ConfirmMoves. The caller must hold games.mu.
+func proposeMove(room *GameRoom, userID string, index int) error {
+	if _, err := checkMove(room, userID, index); err != nil {
+		return err
+	}
+	room.pendingMove = &index
+	touchRoom(room, time.Now().UTC())
+	return nil
+}
+
+// checkMove validates a move by the given user, returning their symbol.
+// It also applies any expired timers. The caller must hold games.mu.
+func checkMove(room *GameRoom, userID string, index int) (string, error) {
+	// Verify game is in progress
+	if room.Status != "playing" {
+		return "", notPlayingError(room)
+	}
+	// Joining fills both seats before play starts, but don't rely on it
+	if room.PlayerX == nil || room.PlayerO == nil {
+		log.Printf("Game %s: playing without two players", room.Code)
+		return "", errMissingPlayer
+	}
+	// Joining never seats a user against themselves, but a room built
+	// some other way could, and playerSymbol would then only see X
+	if room.PlayerX.ID == room.PlayerO.ID {
+		log.Printf("Game %s: %s holds both seats", room.Code, room.PlayerX.Username)
+		return "", errSamePlayer
+	}
+
+	// Win detection indexes the board by size, so a mismatch would panic
+	if !boardMatchesSize(room) {
+		log.Printf("Game %s: board has %d cells but size is %d", room.Code, len(room.Board), room.BoardSize)
+		return "", errBoardMisconfigured
+	}
+	if err := validateRoom(room); err != nil {
+		log.Printf("Game %s: refusing move on impossible board: %v", room.Code, err)
+		return "", errCorruptRoom
+	}
+
+	if room.Paused {
+		return "", errGamePaused
+	}
+	if checkTimers(room) {
+		return "", errTimeExpired
+	}
+
+	// Verify it's this player's turn, by the seat's user rather than
+	// just the symbol
+	symbol := playerSymbol(room, userID)
+	if symbol == "" {
+		return "", errNotInGame
+	}
+	turnPlayer := room.PlayerX
+	if room.CurrentTurn == "O" {
+		turnPlayer = room.PlayerO
+	}
+	if turnPlayer.ID != userID {
+		return "", errNotYourTurn
+	}
+
+	// Verify move is valid
+	if index < 0 || index >= len(room.Board) {
+		return "", errInvalidPosition
+	}
+	if room.Board[index] != "" {
+		return "", errCellTaken
+	}
+
+	return symbol, nil
+}
+
+// snapshotRoom copies room, with its own board, move lists, and players,
+// so the copy can be encoded after games.mu is released while play goes
+// on. The caller must hold games.mu.
+func snapshotRoom(room *GameRoom) *GameRoom {
+	snapshot := *room
+	snapshot.Board = slices.Clone(room.Board)
+	snapshot.WinningLine = slices.Clone(room.WinningLine)
+	snapshot.Moves = slices.Clone(room.Moves)
+	snapshot.SkippedTurns = slices.Clone(room.SkippedTurns)
+	snapshot.history = nil
+	snapshot.departed = nil
+
+	db.mu.RLock()
+	snapshot.PlayerX = snapshotUser(room.PlayerX)
+	snapshot.PlayerO = snapshotUser(room.PlayerO)
+	db.mu.RUnlock()
+	return &snapshot
+}
+
+// snapshotUser copies user, including the maps that change in place. The
+// caller must hold db.mu.
+func snapshotUser(user *User) *User {
+	if user == nil {
+		return nil
+	}
+	snapshot := *user
+	if user.SizeScores != nil {
+		snapshot.SizeScores = make(map[int]*Scores, len(user.SizeScores))
+		for size, scores := range user.SizeScores {
+			sized := *scores
+			snapshot.SizeScores[size] = &sized
+		}
+	}
+	snapshot.Preferences = maps.Clone(user.Preferences)
+	return &snapshot
+}
+
+// gameStateFor builds the state response for user, who may be nil, from a
+// snapshot of room. The caller must hold games.mu.
+func gameStateFor(room *GameRoom, user *User) gameStateResponse {
+	state := gameStateResponse{GameRoom: snapshotRoom(room)}
+	if user != nil {
+		state.YourSymbol = playerSymbol(room, user.ID)
+	}
+	state.YourTurn = state.YourSymbol != "" && room.Status == "playing" && room.CurrentTurn == state.YourSymbol
+	if state.YourTurn {
+		state.PendingMove = room.pendingMove
+	}
+
+	for _, cell := range room.Board {
+		if cell != "" {
+			state.MoveCount++
+		}
+	}
+	if !room.StartedAt.IsZero() {
+		end := room.FinishedAt
+		if end.IsZero() {
+			end = time.Now().UTC()
+		}
+		state.Duration = end.Sub(room.StartedAt).Seconds()
+	}
+	if room.Status == "waiting" {
+		// Matches sweepOldGames, which removes rooms idle for gameTTL
+		expires := room.UpdatedAt.Add(gameTTL)
+		state.ExpiresAt = &expires
+	}
+	return state
+}
+
+// legalMoves returns the indices of the empty cells, in board order
+func legalMoves(room *GameRoom) []int {
+	moves := []int{}
+	for i, cell := range room.Board {
+		if cell == "" {
+			moves = append(moves, i)
+		}
+	}
+	return moves
+}
+
+// moveWarnings lists warning codes worth showing the player who just moved
+// as symbol. The caller must hold games.mu.
+func moveWarnings(room *GameRoom, symbol string) []string {
+	if room.Status != "playing" {
+		return nil
+	}
+
+	var warnings []string
+	if drawInevitable(room) {
+		warnings = append(warnings, warnDrawInevitable)
+	}
+	if room.TotalSeconds > 0 {
+		remaining := room.TimeLeftX
+		if symbol == "O" {
+			remaining = room.TimeLeftO
+		}
+		if remaining < lowTimeSeconds {
+			warnings = append(warnings, warnLowTime)
+		}
+	}
+	return warnings
+}
+
+// drawInevitable reports whether every winning line already holds both
+// symbols, so the game can only end in a draw
+func drawInevitable(room *GameRoom) bool {
+	for _, condition := range winConditions(room) {
+		hasX, hasO := false, false
+		for _, idx := range condition {
+			hasX = hasX || room.Board[idx] == "X"
+			hasO = hasO || room.Board[idx] == "O"
+		}
+		if !hasX || !hasO {
+			return false
+		}
+	}
+	return true
+}
+
+// timeRemaining returns a player's remaining clock, counting the running turn
+func timeRemaining(room *GameRoom, symbol string) float64 {
+	remaining := room.TimeLeftX
+	if symbol == "O" {
+		remaining = room.TimeLeftO
+	}
+	if room.Status == "playing" && room.CurrentTurn == symbol {
+		end := time.Now()
+		if room.Paused {
+			end = room.PausedAt
+		}
+		remaining -= end.Sub(room.TurnStartedAt).Seconds()
+	}
+	return remaining
+}
+
+// otherSymbol returns the opponent of "X" or "O"
+func otherSymbol(symbol string) string {
+	if symbol == "X" {
+		return "O"
+	}
+	return "X"
+}
+
+// checkTimers applies the turn timer and game clock, reporting whether a
+// timeout ended the game. An expired ready check is cancelled too, though
+// that ends the game without a result. The caller must hold games.mu.
+func checkTimers(room *GameRoom) bool {
+	expireReadyCheck(room)
+	if room.Paused {
+		return false
+	}
+	return expireTurn(room) || expireClock(room)
+}
+
+// expireReadyCheck cancels a game whose players did not both confirm
+// they were ready in time
+func expireReadyCheck(room *GameRoom) {
+	if room.Status != "ready_check" || time.Now().Before(room.ReadyDeadline) {
+		return
+	}
+	log.Printf("Game %s: ready check timed out", room.Code)
+	cancelGame(room)
+}
+
+// cancelGame ends a game that never started, with no result. The room is
+// kept for finishedRetention so both players see why it ended.
+func cancelGame(room *GameRoom) {
+	now := time.Now().UTC()
+	room.Status = "cancelled"
+	room.FinishedAt = now
+	touchRoom(room, now)
+}
+
+// expireTurn applies the room's timeout policy if the player to move has
+// overrun the per-turn limit: under "skip" the turn passes to the
+// opponent (repeatedly, if several limits have elapsed), otherwise the
+// player forfeits. It reports whether the game ended.
+func expireTurn(room *GameRoom) bool {
+	if room.TurnSeconds == 0 || room.Status != "playing" {
+		return false
+	}
+
+	limit := time.Duration(room.TurnSeconds) * time.Second
+	for time.Since(room.TurnStartedAt) >= limit {
+		if room.TimeoutPolicy != "skip" {
+			log.Printf("Game %s: %s timed out and forfeits", room.Code, room.CurrentTurn)
+			forfeitGame(room, room.CurrentTurn)
+			return true
+		}
+
+		// The skipped turn still counts against the game clock
+		if room.TotalSeconds > 0 {
+			if room.CurrentTurn == "X" {
+				room.TimeLeftX -= limit.Seconds()
+			} else {
+				room.TimeLeftO -= limit.Seconds()
+			}
+		}
+
+		skippedAt := room.TurnStartedAt.Add(limit)
+		room.SkippedTurns = append(room.SkippedTurns, TurnSkip{Symbol: room.CurrentTurn, At: skippedAt, AfterMove: len(room.Moves)})
+		log.Printf("Game %s: %s timed out, turn skipped", room.Code, room.CurrentTurn)
+		room.CurrentTurn = otherSymbol(room.CurrentTurn)
+		room.pendingMove = nil
+		room.TurnStartedAt = skippedAt
+		touchRoom(room, time.Now().UTC())
+	}
+	return false
+}
+
+// expireClock forfeits the game for the player to move if their clock has
+// run out, reporting whether it did. The caller must hold games.mu.
+func expireClock(room *GameRoom) bool {
+	if room.TotalSeconds == 0 || room.Status != "playing" {
+		return false
+	}
+	if timeRemaining(room, room.CurrentTurn) > 0 {
+		return false
+	}
+
+	if room.CurrentTurn == "X" {
+		room.TimeLeftX = 0
+	} else {
+		room.TimeLeftO = 0
+	}
+	forfeitGame(room, room.CurrentTurn)
+	log.Printf("Game %s: %s ran out of time", room.Code, room.CurrentTurn)
+	return true
+}
+
+// forfeitGame ends the game with symbol conceding to the opponent
+func forfeitGame(room *GameRoom, symbol string) {
+	room.ForfeitedBy = symbol
+	finishGame(room, otherSymbol(symbol))
+}
+
+// finishGame ends the game with winner "X", "O", or "draw"
+func finishGame(room *GameRoom, winner string) {
+	now := time.Now().UTC()
+	room.Winner = winner
+	room.Status = "finished"
+	room.FinishedAt = now
+	room.WinRevealAt = now
+	if room.WinningLine != nil {
+		room.WinRevealAt = now.Add(winRevealDelay)
+	}
+	touchRoom(room, now)
+
+	if games.OnGameFinished != nil {
+		games.OnGameFinished(gameResult(room))
+	}
+
+	// Practice games can be undone and finished again, and aren't results
+	if room.Mode == "practice" {
+		return
+	}
+
+	recent := RecentGame{
+		Code:       room.Code,
+		BoardSize:  room.BoardSize,
+		Winner:     room.Winner,
+		FinishedAt: room.FinishedAt,
+	}
+	if room.PlayerX != nil {
+		recent.PlayerX = room.PlayerX.Username
+	}
+	if room.PlayerO != nil {
+		recent.PlayerO = room.PlayerO.Username
+	}
+	games.recent = append(games.recent, recent)
+	if len(games.recent) > recentGamesCap {
+		games.recent = games.recent[len(games.recent)-recentGamesCap:]
+	}
+}
+
+// gameResult summarizes a finished room for OnGameFinished
+func gameResult(room *GameRoom) GameResult {
+	result := GameResult{
+		Code:      room.Code,
+		BoardSize: room.BoardSize,
+		WinLength: room.WinLength,
+		Mode:      "untimed",
+		Winner:    room.Winner,
+		Duration:  room.FinishedAt.Sub(room.StartedAt).Seconds(),
+	}
+	if room.Mode == "practice" {
+		result.Mode = "practice"
+	} else if room.TotalSeconds > 0 || room.TurnSeconds > 0 {
+		result.Mode = "timed"
+	}
+	for _, cell := range room.Board {
+		if cell != "" {
+			result.MoveCount++
+		}
+	}
+	return result
+}
+
+// logGameResult writes a game result as a single structured log record
+func logGameResult(result GameResult) {
+	slog.Info("game finished",
+		"code", result.Code,
+		"board_size", result.BoardSize,
+		"win_length", result.WinLength,
+		"mode", result.Mode,
+		"winner", result.Winner,
+		"move_count", result.MoveCount,
+		"duration_seconds", result.Duration,
+	)
+}
+
+// touchRoom marks a change to room at now, bumping its version and
+// remembering the new state for later diffs
+func touchRoom(room *GameRoom, now time.Time) {
+	room.UpdatedAt = now
+	room.Version++
+	room.history = append(room.history, roomSnapshot{
+		Version:     room.Version,
+		Board:       append([]string(nil), room.Board...),
+		CurrentTurn: room.CurrentTurn,
+		Status:      room.Status,
+		Winner:      room.Winner,
+	})
+	if len(room.history) > diffHistory {
+		room.history = room.history[len(room.history)-diffHistory:]
+	}
+}
+
+// diffSince describes how room has changed since version since, or
+// returns false if that version is no longer in its history
+func diffSince(room *GameRoom, since int) (stateDiff, bool) {
+	diff := stateDiff{Version: room.Version, Since: since}
+	var old *roomSnapshot
+	for i := range room.history {
+		if room.history[i].Version == since {
+			old = &room.history[i]
+			break
+		}
+	}
+	if old == nil {
+		return diff, false
+	}
+
+	for i, cell := range room.Board {
+		if cell != old.Board[i] {
+			if diff.Cells == nil {
+				diff.Cells = make(map[int]string)
+			}
+			diff.Cells[i] = cell
+		}
+	}
+	if room.CurrentTurn != old.CurrentTurn {
+		diff.CurrentTurn = room.CurrentTurn
+	}
+	if room.Status != old.Status {
+		diff.Status = room.Status
+	}
+	if room.Winner != old.Winner {
+		diff.Winner = room.Winner
+		diff.WinningLine = room.WinningLine
+	}
+	return diff, true
+}
+
+// recordResult applies a finished room's outcome to both players' scores.
+// Forfeits are scored according to forfeitScoring, and practice games
+// not at all.
+func recordResult(room *GameRoom) {
+	if room.Mode == "practice" {
+		return
+	}
+
+	if room.ForfeitedBy != "" && forfeitScoring != "loss" {
+		if forfeitScoring == "forfeit" {
+			winner, forfeiter := room.PlayerX, room.PlayerO
+			if room.ForfeitedBy == "X" {
+				winner, forfeiter = forfeiter, winner
+			}
+			if winner != nil {
+				addScore(winner, room.BoardSize, "win")
+				addScore(forfeiter, room.BoardSize, "forfeit")
+			}
+		}
+		return
+	}
+
+	switch room.Winner {
+	case "X":
+		if room.PlayerX != nil {
+			addScore(room.PlayerX, room.BoardSize, "win")
+			addScore(room.PlayerO, room.BoardSize, "loss")
+		}
+	case "O":
+		if room.PlayerO != nil {
+			addScore(room.PlayerO, room.BoardSize, "win")
+			addScore(room.PlayerX, room.BoardSize, "loss")
+		}
+	case "draw":
+		addScore(room.PlayerX, room.BoardSize, "draw")
+		addScore(room.PlayerO, room.BoardSize, "draw")
+	}
+}
+
+// addScore counts a "win", "loss", or "draw" in a user's overall scores and
+// in their scores for the board size. A nil user is ignored.
+func addScore(user *User, size int, result string) {
+	if user == nil {
+		return
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if user.SizeScores == nil {
+		user.SizeScores = make(map[int]*Scores)
+	}
+	if user.SizeScores[size] == nil {
+		user.SizeScores[size] = &Scores{}
+	}
+
+	for _, scores := range []*Scores{&user.Scores, user.SizeScores[size]} {
+		switch result {
+		case "win":
+			scores.Wins++
+		case "loss":
+			scores.Losses++
+		case "draw":
+			scores.Draws++
+		case "forfeit":
+			scores.Forfeits++
+		}
+	}
+	leaderboardVersion.Add(1)
+}
+
+// addMoveTime adds one move's think time to the user's speed stats. The
+// totals are saved with the game's result.
+func addMoveTime(user *User, seconds float64) {
+	if user == nil {
+		return
+	}
+
+	db.mu.Lock()
+	user.MoveSeconds += seconds
+	user.TimedMoves++
+	user.AvgMoveSeconds = user.MoveSeconds / float64(user.TimedMoves)
+	db.mu.Unlock()
+	leaderboardVersion.Add(1)
+}
+
+// indexToRowCol converts a cell index to its zero-based row and column
+func indexToRowCol(index, size int) (int, int) {
+	return index / size, index % size
+}
+
+// rowColToIndex converts a zero-based row and column to a cell index
+func rowColToIndex(row, col, size int) int {
+	return row*size + col
+}
+
+// canonicalKey returns a key for the board that is the same for all eight
+// rotations and reflections of a position: the lexicographically smallest
+// encoding among them, with "-" for empty cells.
+func canonicalKey(board []string, size int) string {
+	best := ""
+	for t := 0; t < 8; t++ {
+		var sb strings.Builder
+		for i := range board {
+			r, c := indexToRowCol(i, size)
+			if t&4 != 0 {
+				r, c = c, r // transpose
+			}
+			if t&2 != 0 {
+				r = size - 1 - r // flip vertically
+			}
+			if t&1 != 0 {
+				c = size - 1 - c // flip horizontally
+			}
+			cell := board[rowColToIndex(r, c, size)]
+			if cell == "" {
+				cell = "-"
+			}
+			sb.WriteString(cell)
+		}
+		if key := sb.String(); best == "" || key < best {
+			best = key
+		}
+	}
+	return best
+}
+
+// ==================== User Management Handlers ====================
+
+// dataFiles names the files persisted in the data directory
+var dataFiles = []string{"users.json", "users.json.tmp"}
+
+// dataDirs names directories in the data directory that are private in
+// their entirety, such as the autocert cache holding TLS private keys
+var dataDirs = []string{"autocert"}
+
+// staticHandler serves static files, hiding the data directory and its
+// files when they lie under the served root
+func staticHandler(fs http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isDataPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// isDataPath reports whether a URL path resolves inside the data directory
+// or, when the data directory is the served root, to one of its data files
+// or data directories
+func isDataPath(urlPath string) bool {
+	root, err := filepath.Abs(".")
+	if err != nil {
+		return true
+	}
+	data, err := filepath.Abs(dataDir)
+	if err != nil {
+		return true
+	}
+
+	target := filepath.Join(root, filepath.FromSlash(path.Clean("/"+urlPath)))
+	if data != root && (target == data || strings.HasPrefix(target, data+string(filepath.Separator))) {
+		return true
+	}
+
+	for _, name := range dataFiles {
+		// Compare case-insensitively for case-insensitive filesystems
+		if strings.EqualFold(target, filepath.Join(data, name)) {
+			return true
+		}
+	}
+	for _, name := range dataDirs {
+		dir := strings.ToLower(filepath.Join(data, name))
+		lower := strings.ToLower(target)
+		if lower == dir || strings.HasPrefix(lower, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHealthz reports that the server is up
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// handleUnknownAPI answers API paths with no handler, so API clients get
+// a JSON error instead of the file server's plain-text 404
+func handleUnknownAPI(w http.ResponseWriter, r *http.Request) {
+	jsonErrorCode(w, "unknown_endpoint", "Unknown API endpoint: "+r.URL.Path, http.StatusNotFound)
+}
+
+// handleVersion reports which build is running
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"go_version": runtime.Version(),
+	})
+}
+
+// handleRegister creates a new user
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if registration == "closed" {
+		jsonErrorCode(w, "registration_closed", "Registration is closed", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if n := utf8.RuneCountInString(req.Username); n < usernameMin || n > usernameMax {
+		jsonFieldError(w, "invalid_field", "username", fmt.Sprintf("username must be %d to %d characters", usernameMin, usernameMax), http.StatusBadRequest)
+		return
+	}
+
+	if isUsernameReserved(req.Username) {
+		jsonFieldError(w, "invalid_field", "username", "Username is reserved", http.StatusBadRequest)
+		return
+	}
+
+	if isUsernameBlocked(req.Username) {
+		jsonFieldError(w, "invalid_field", "username", "Username not allowed", http.StatusBadRequest)
+		return
+	}
+
+	// Check if username exists
+	if findUserByUsername(req.Username) != nil {
+		jsonFieldError(w, "username_taken", "username", "Username already taken", http.StatusConflict)
+		return
+	}
+
+	// Create new user
+	user := &User{
+		ID:        generateID(),
+		Username:  req.Username,
+		Scores:    Scores{},
+		CreatedAt: time.Now().UTC(),
+	}
+
+	db.mu.Lock()
+	db.Users[user.ID] = user
+	db.mu.Unlock()
+	leaderboardVersion.Add(1)
+
+	if err := saveUsers(user); err != nil {
+		logf(r, "Error saving database: %v", err)
+	}
+
+	// Create session
+	token := sessions.create(user.ID)
+
+	jsonResponse(w, map[string]interface{}{
+		"user":  user,
+		"token": token,
+	})
+}
+
+// handleLogin logs in an existing user
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	// Unknown usernames get the same generic response as any other failed
+	// login so valid usernames can't be enumerated
+	user := findUserByUsername(req.Username)
+	if user == nil || user.Guest {
+		jsonError(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	// Create session
+	token := sessions.create(user.ID)
+
+	jsonResponse(w, map[string]interface{}{
+		"user":  user,
+		"token": token,
+	})
+}
+
+// handleGuest creates a throwaway guest account and session. Guests can
+// play online but are never saved or shown on the leaderboard, and the
+// account is deleted when its session ends or after guestTTL.
+func handleGuest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if registration == "closed" {
+		jsonErrorCode(w, "registration_closed", "Registration is closed", http.StatusForbidden)
+		return
+	}
+
+	// Names are drawn from about a billion, so a few tries always suffice
+	// unless something is badly wrong
+	var username string
+	for attempt := 0; ; attempt++ {
+		if attempt == 10 {
+			jsonError(w, "Could not pick a guest name, try again", http.StatusServiceUnavailable)
+			return
+		}
+		username = "Guest-" + generateGameCode()
+		if findUserByUsername(username) == nil {
+			break
+		}
+	}
+
+	user := &User{
+		ID:        generateID(),
+		Username:  username,
+		Scores:    Scores{},
+		Guest:     true,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	db.mu.Lock()
+	db.Users[user.ID] = user
+	db.mu.Unlock()
+
+	token := sessions.create(user.ID)
+
+	jsonResponse(w, map[string]interface{}{
+		"user":  user,
+		"token": token,
+	})
+}
+
+// handleLogout logs out a user
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, _ := parseAuthToken(r.Header.Get("Authorization"))
+	if token != "" {
+		sessions.remove(token)
+	}
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// handleGetUser returns current user info
+func handleGetUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	jsonResponse(w, user)
+}
+
+// handleExportUser returns everything stored about the current user, plus
+// the finished games they played that are still in the recent feed, as a
+// JSON file download
+func handleExportUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// Marshal under the lock, since scores and preferences change in place
+	db.mu.RLock()
+	account, err := json.Marshal(user)
+	db.mu.RUnlock()
+	if err != nil {
+		jsonError(w, "Failed to export account", http.StatusInternalServerError)
+		return
+	}
+
+	games.mu.RLock()
+	played := []RecentGame{}
+	for i := len(games.recent) - 1; i >= 0; i-- {
+		game := games.recent[i]
+		if game.PlayerX == user.Username || game.PlayerO == user.Username {
+			played = append(played, game)
+		}
+	}
+	games.mu.RUnlock()
+
+	w.Header().Set("Content-Disposition", `attachment; filename="tictactoe-account.json"`)
+	jsonResponse(w, map[string]interface{}{
+		"exported_at":  time.Now().UTC(),
+		"account":      json.RawMessage(account),
+		"recent_games": played,
+	})
+}
+
+// handleUpdateScore updates user's score
+func handleUpdateScore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req struct {
+		Result string `json:"result" validate:"oneof=win loss draw"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	db.mu.Lock()
+	switch req.Result {
+	case "win":
+		user.Scores.Wins++
+	case "loss":
+		user.Scores.Losses++
+	case "draw":
+		user.Scores.Draws++
+	default:
+		db.mu.Unlock()
+		jsonError(w, "Invalid result type", http.StatusBadRequest)
+		return
+	}
+	db.mu.Unlock()
+	leaderboardVersion.Add(1)
+
+	if err := saveUsers(user); err != nil {
+		logf(r, "Error saving database: %v", err)
+		jsonError(w, "Failed to save score", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, user)
+}
+
+// Limits on stored preferences, keeping user records small
+const (
+	maxPreferences        = 32
+	maxPreferenceKeyLen   = 32
+	maxPreferenceValueLen = 256
+)
+
+// handlePreferences returns the current user's preferences on GET. POST
+// merges the given preferences into the stored ones; an empty value
+// removes that key.
+func handlePreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if r.Method == "GET" {
+		db.mu.RLock()
+		prefs := make(map[string]string, len(user.Preferences))
+		for key, value := range user.Preferences {
+			prefs[key] = value
+		}
+		db.mu.RUnlock()
+
+		jsonResponse(w, map[string]interface{}{"preferences": prefs})
+		return
+	}
+
+	var req struct {
+		Preferences map[string]string `json:"preferences"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	for key, value := range req.Preferences {
+		if key == "" || utf8.RuneCountInString(key) > maxPreferenceKeyLen {
+			jsonErrorCode(w, "invalid_preference", fmt.Sprintf("Preference names must be 1 to %d characters", maxPreferenceKeyLen), http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(value) > maxPreferenceValueLen {
+			jsonErrorCode(w, "invalid_preference", fmt.Sprintf("Preference %s is longer than %d characters", key, maxPreferenceValueLen), http.StatusBadRequest)
+			return
+		}
+	}
+
+	db.mu.Lock()
+	merged := make(map[string]string, len(user.Preferences)+len(req.Preferences))
+	for key, value := range user.Preferences {
+		merged[key] = value
+	}
+	for key, value := range req.Preferences {
+		if value == "" {
+			delete(merged, key)
+		} else {
+			merged[key] = value
+		}
+	}
+	if len(merged) > maxPreferences {
+		db.mu.Unlock()
+		jsonErrorCode(w, "too_many_preferences", fmt.Sprintf("At most %d preferences can be stored", maxPreferences), http.StatusBadRequest)
+		return
+	}
+	if len(merged) == 0 {
+		merged = nil
+	}
+	user.Preferences = merged
+	prefs := make(map[string]string, len(merged))
+	for key, value := range merged {
+		prefs[key] = value
+	}
+	db.mu.Unlock()
+
+	if err := saveUsers(user); err != nil {
+		logf(r, "Error saving database: %v", err)
+		jsonError(w, "Failed to save", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, map[string]interface{}{"preferences": prefs})
+}
+
+// handleResetScores zeroes the current user's wins, losses, and draws,
+// including their per-board-size breakdown
+func handleResetScores(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	db.mu.Lock()
+	user.Scores = Scores{}
+	user.SizeScores = nil
+	reset := snapshotUser(user)
+	db.mu.Unlock()
+	leaderboardVersion.Add(1)
+
+	if err := saveUsers(user); err != nil {
+		logf(r, "Error saving database: %v", err)
+		jsonError(w, "Failed to save", http.StatusInternalServerError)
+		return
+	}
+
+	logf(r, "Scores reset for %s", user.Username)
+
+	jsonResponse(w, reset)
+}
+
+// handleLeaderboard returns top players. The X-Leaderboard-Version header
+// identifies the data; passing it back as since yields 304 if unchanged.
+func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// An optional board_size limits the board to results on that size,
+	// reported in each entry's scores
+	boardSize := 0
+	if param := r.URL.Query().Get("board_size"); param != "" {
+		size, err := strconv.Atoi(param)
+		if err != nil || size < 1 {
+			jsonError(w, "Invalid board size", http.StatusBadRequest)
+			return
+		}
+		boardSize = size
+	}
+
+	// sort=speed ranks by average think time per move instead of wins,
+	// among players with at least speedMinMoves timed moves
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy != "" && sortBy != "wins" && sortBy != "speed" {
+		jsonError(w, "sort must be wins or speed", http.StatusBadRequest)
+		return
+	}
+
+	// A client passing the version it last saw gets 304 if nothing changed
+	version := leaderboardVersion.Load()
+	w.Header().Set("X-Leaderboard-Version", strconv.FormatInt(version, 10))
+	if param := r.URL.Query().Get("since"); param != "" {
+		since, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			jsonError(w, "Invalid since version", http.StatusBadRequest)
+			return
+		}
+		if since == version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	db.mu.RLock()
+	users := make([]*User, 0, len(db.Users))
+	for _, user := range db.Users {
+		if user.Guest {
+			continue
+		}
+		if sortBy == "speed" && user.TimedMoves < speedMinMoves {
+			continue
+		}
+		if boardSize == 0 {
+			users = append(users, snapshotUser(user))
+		} else if sized := user.SizeScores[boardSize]; sized != nil {
+			users = append(users, &User{
+				ID:             user.ID,
+				Username:       user.Username,
+				Scores:         *sized,
+				CreatedAt:      user.CreatedAt,
+				MoveSeconds:    user.MoveSeconds,
+				TimedMoves:     user.TimedMoves,
+				AvgMoveSeconds: user.AvgMoveSeconds,
+			})
+		}
+	}
+	db.mu.RUnlock()
+
+	if sortBy == "speed" {
+		sort.SliceStable(users, func(i, j int) bool {
+			return users[i].AvgMoveSeconds < users[j].AvgMoveSeconds
+		})
+	} else {
+		// Sort by wins (simple bubble sort for small lists)
+		for i := 0; i < len(users)-1; i++ {
+			for j := 0; j < len(users)-i-1; j++ {
+				if users[j].Scores.Wins < users[j+1].Scores.Wins {
+					users[j], users[j+1] = users[j+1], users[j]
+				}
+			}
+		}
+	}
+
+	// Return top 10
+	limit := 10
+	if len(users) < limit {
+		limit = len(users)
+	}
+
+	jsonResponse(w, users[:limit])
+}
+
+// ==================== Game Room Handlers ====================
+
+// handleCreateGame creates a new game room
+func handleCreateGame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req struct {
+		BoardSize     int    `json:"board_size"`
+		WinLength     int    `json:"win_length"`
+		TotalSeconds  int    `json:"total_seconds" validate:"min=0"`
+		TurnSeconds   int    `json:"turn_seconds" validate:"min=0"`
+		TimeoutPolicy string `json:"timeout_policy" validate:"omitempty,oneof=forfeit skip"`
+		HintsDisabled bool   `json:"hints_disabled"`
+		SymbolX       string `json:"symbol_x" validate:"omitempty,max=2"`
+		SymbolO       string `json:"symbol_o" validate:"omitempty,max=2"`
+		ConfirmMoves  bool   `json:"confirm_moves"`
+		Mode          string `json:"mode" validate:"omitempty,oneof=standard practice"`
+		WinPattern    string `json:"win_pattern" validate:"omitempty,oneof=line square corners"`
+		ReadyCheck    bool   `json:"ready_check"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if defaultWinLength(req.BoardSize) == 0 {
+		req.BoardSize = 3
+	}
+
+	// Validate win length against the board (0 means use the default)
+	if req.WinLength == 0 {
+		req.WinLength = defaultWinLength(req.BoardSize)
+	}
+	if req.WinLength < 3 {
+		jsonErrorCode(w, "win_length_too_short", "Win length must be at least 3", http.StatusBadRequest)
+		return
+	}
+	if req.WinLength > req.BoardSize {
+		jsonErrorCode(w, "win_length_too_long", "Win length cannot exceed board size", http.StatusBadRequest)
+		return
+	}
+
+	if req.TimeoutPolicy == "" {
+		req.TimeoutPolicy = "forfeit"
+	}
+	if req.Mode == "" {
+		req.Mode = "standard"
+	}
+	if req.WinPattern == "" {
+		req.WinPattern = "line"
+	}
+
+	// Custom markers are display-only; rules and scoring use "X" and "O"
+	if req.SymbolX == "" {
+		req.SymbolX = "X"
+	}
+	if req.SymbolO == "" {
+		req.SymbolO = "O"
+	}
+	if strings.TrimSpace(req.SymbolX) == "" || strings.TrimSpace(req.SymbolO) == "" {
+		jsonErrorCode(w, "invalid_symbol", "Symbols must not be blank", http.StatusBadRequest)
+		return
+	}
+	if req.SymbolX == req.SymbolO {
+		jsonErrorCode(w, "invalid_symbol", "Players must have different symbols", http.StatusBadRequest)
+		return
+	}
+
+	idemKey := idempotencyKey{UserID: user.ID, Key: r.Header.Get("Idempotency-Key")}
+
+	games.mu.Lock()
+	if idemKey.Key != "" {
+		// A retry of a create that already succeeded gets the same room
+		// back, as long as the key is fresh and the room still exists
+		if entry, ok := games.created[idemKey]; ok && time.Since(entry.CreatedAt) <= idempotencyTTL {
+			if room, ok := games.rooms[entry.RoomID]; ok {
+				snapshot := snapshotRoom(room)
+				games.mu.Unlock()
+				jsonResponse(w, snapshot)
+				return
+			}
+		}
+	}
+	if games.restarting {
+		games.mu.Unlock()
+		jsonErrorCode(w, "server_restarting", "Server is restarting, try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	if maxGames > 0 && activeRoomCount() >= maxGames {
+		games.mu.Unlock()
+		jsonErrorCode(w, "server_busy", "Too many active games, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	code := uniqueGameCode()
+
+	room := &GameRoom{
+		ID:            generateID(),
+		Code:          code,
+		BoardSize:     req.BoardSize,
+		WinLength:     req.WinLength,
+		WinPattern:    req.WinPattern,
+		Board:         make([]string, req.BoardSize*req.BoardSize),
+		PlayerX:       user,
+		PlayerO:       nil,
+		CurrentTurn:   "X",
+		Status:        "waiting",
+		Winner:        "",
+		WinningLine:   nil,
+		LastMove:      -1,
+		LastMoveBy:    "",
+		TotalSeconds:  req.TotalSeconds,
+		TurnSeconds:   req.TurnSeconds,
+		TimeoutPolicy: req.TimeoutPolicy,
+		HintsDisabled: req.HintsDisabled,
+		SymbolX:       req.SymbolX,
+		SymbolO:       req.SymbolO,
+		ConfirmMoves:  req.ConfirmMoves,
+		ReadyCheck:    req.ReadyCheck,
+		Mode:          req.Mode,
+		TimeLeftX:     float64(req.TotalSeconds),
+		TimeLeftO:     float64(req.TotalSeconds),
+		CreatedAt:     time.Now().UTC(),
+	}
+	touchRoom(room, room.CreatedAt)
+
+	games.rooms[room.ID] = room
+	games.codes[code] = room.ID
+	if idemKey.Key != "" {
+		games.created[idemKey] = createdRoom{RoomID: room.ID, CreatedAt: room.CreatedAt}
+	}
+	snapshot := snapshotRoom(room)
+	games.mu.Unlock()
+
+	logf(r, "Game created: %s by %s", code, user.Username)
+
+	jsonResponse(w, snapshot)
+}
+
+// handleJoinGame joins an existing game room
+func handleJoinGame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+
+	games.mu.Lock()
+	roomID, exists := games.codes[code]
+	if !exists {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	room := games.rooms[roomID]
+	if room == nil {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	// Check if user is already in this game
+	if room.PlayerX != nil && room.PlayerX.ID == user.ID {
+		snapshot := snapshotRoom(room)
+		games.mu.Unlock()
+		jsonResponse(w, snapshot)
+		return
+	}
+
+	if room.PlayerO != nil && room.PlayerO.ID == user.ID {
+		snapshot := snapshotRoom(room)
+		games.mu.Unlock()
+		jsonResponse(w, snapshot)
+		return
+	}
+
+	// A room whose host handed it over to the next joiner gets a new host
+	if room.PlayerX == nil && room.Status == "waiting" {
+		room.PlayerX = user
+		touchRoom(room, time.Now().UTC())
+		snapshot := snapshotRoom(room)
+		games.mu.Unlock()
+
+		logf(r, "Game %s: %s joined as host", code, user.Username)
+
+		jsonResponse(w, snapshot)
+		return
+	}
+
+	// Check if game is full
+	if room.PlayerO != nil {
+		games.mu.Unlock()
+		jsonError(w, "Game is full", http.StatusConflict)
+		return
+	}
+
+	// Join as player O. With a ready check, play waits for both players
+	// to confirm through /api/game/ready.
+	room.PlayerO = user
+	if room.ReadyCheck {
+		room.Status = "ready_check"
+		room.ReadyDeadline = time.Now().UTC().Add(readyCheckTimeout)
+	} else {
+		startGame(room, time.Now().UTC())
+	}
+	touchRoom(room, time.Now().UTC())
+	snapshot := snapshotRoom(room)
+	games.mu.Unlock()
+
+	logf(r, "Game %s: %s joined as O", code, user.Username)
+
+	jsonResponse(w, snapshot)
+}
+
+// handleCheckGame reports whether a join code exists and can be joined,
+// without joining it
+func handleCheckGame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+	if code == "" {
+		jsonError(w, "Code required", http.StatusBadRequest)
+		return
+	}
+
+	games.mu.RLock()
+	room := games.rooms[games.codes[code]]
+	if room == nil {
+		games.mu.RUnlock()
+		jsonErrorCode(w, "not_found", "No game with that code", http.StatusNotFound)
+		return
+	}
+
+	host := ""
+	if room.PlayerX != nil {
+		host = room.PlayerX.Username
+	}
+	result := map[string]interface{}{
+		"code":       room.Code,
+		"status":     room.Status,
+		"board_size": room.BoardSize,
+		"win_length": room.WinLength,
+		"host":       host,
+		"joinable":   room.Status == "waiting" && room.PlayerO == nil,
+	}
+	games.mu.RUnlock()
+
+	jsonResponse(w, result)
+}
+
+// handleGameState returns current game state
+func handleGameState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		jsonError(w, "Room ID required", http.StatusBadRequest)
+		return
+	}
+
+	user := getUserFromToken(r)
+
+	// Large boards are costly for clients to scan, so they can ask for
+	// the empty cells to be listed; it's opt-in to keep payloads small
+	withLegal := r.URL.Query().Get("legal_moves") == "1"
+
+	games.mu.Lock()
+	room := games.rooms[roomID]
+	var state gameStateResponse
+	if room != nil {
+		if checkTimers(room) {
+			recordResult(room)
+			persistResult(room)
+		}
+
+		// Auto-clear emote after 3 seconds
+		if room.ShowEmote && time.Since(room.EmoteAt) > 3*time.Second {
+			room.ShowEmote = false
+			room.EmoteType = ""
+			room.EmoteBy = ""
+		}
+
+		state = gameStateFor(room, user)
+		if withLegal && room.Status == "playing" {
+			state.LegalMoves = legalMoves(room)
+		}
+	}
+	games.mu.Unlock()
+
+	if room == nil {
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	jsonResponse(w, state)
+}
+
+// handleGameStateDiff returns only what changed in a game since the
+// client's since_version, or the full state if that is too far back
+func handleGameStateDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		jsonError(w, "Room ID required", http.StatusBadRequest)
+		return
+	}
+	since, err := strconv.Atoi(r.URL.Query().Get("since_version"))
+	if err != nil || since < 0 {
+		jsonError(w, "since_version must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	user := getUserFromToken(r)
+
+	games.mu.Lock()
+	room := games.rooms[roomID]
+	var diff stateDiff
+	if room != nil {
+		if checkTimers(room) {
+			recordResult(room)
+			persistResult(room)
+		}
+
+		var ok bool
+		diff, ok = diffSince(room, since)
+		if !ok {
+			state := gameStateFor(room, user)
+			diff.Full = &state
+		}
+	}
+	games.mu.Unlock()
+
+	if room == nil {
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	jsonResponse(w, diff)
+}
+
+// handleGameHint suggests the best move for the player to move, found by
+// alpha-beta search of the current board
+func handleGameHint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		jsonError(w, "Room ID required", http.StatusBadRequest)
+		return
+	}
+
+	if !hintLimiter.allow(user.ID, time.Now().UTC()) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(hintLimiter.window.Seconds())))
+		jsonErrorCode(w, "rate_limited", "Too many hints, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	games.mu.RLock()
+	room := games.rooms[roomID]
+	if room == nil {
+		games.mu.RUnlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	symbol := playerSymbol(room, user.ID)
+	var moveErr *MoveError
+	switch {
+	case symbol == "":
+		moveErr = errNotInGame
+	case room.Status != "playing":
+		moveErr = notPlayingError(room)
+	case room.CurrentTurn != symbol:
+		moveErr = errNotYourTurn
+	}
+	if moveErr != nil {
+		games.mu.RUnlock()
+		status := http.StatusBadRequest
+		if moveErr == errNotInGame {
+			status = http.StatusForbidden
+		}
+		jsonErrorCode(w, moveErr.Code, moveErr.Message, status)
+		return
+	}
+	if room.HintsDisabled {
+		games.mu.RUnlock()
+		jsonErrorCode(w, "hints_disabled", "Hints are disabled in this game", http.StatusForbidden)
+		return
+	}
+	if !boardMatchesSize(room) {
+		games.mu.RUnlock()
+		jsonErrorCode(w, errBoardMisconfigured.Code, errBoardMisconfigured.Message, http.StatusInternalServerError)
+		return
+	}
+	search := newSearcher(room.Board, room.BoardSize, winConditions(room))
+	size := room.BoardSize
+	games.mu.RUnlock()
+
+	// Search outside the lock; the searcher has its own copy of the board
+	index := search.bestMove(symbol)
+	row, col := indexToRowCol(index, size)
+
+	jsonResponse(w, map[string]int{"index": index, "row": row, "col": col})
+}
+
+// moveAnnotation is the analysis of one move in a finished game
+type moveAnnotation struct {
+	Ply         int    `json:"ply"` // 1 for the first move
+	Index       int    `json:"index"`
+	Symbol      string `json:"symbol"`
+	Outcome     string `json:"outcome"`      // what the move led to with best play: "win", "draw", "loss", or "unclear"
+	BestIndex   int    `json:"best_index"`   // the searcher's preferred move from the same position
+	BestOutcome string `json:"best_outcome"` // what the preferred move led to
+	Blunder     bool   `json:"blunder"`      // a move with a better outcome was available
+}
+
+// handleGameAnalysis replays a finished game and annotates each move with
+// the outcome it forced, flagging blunders: moves that gave up a win or a
+// draw that another move would have kept. Large boards are searched to a
+// limited depth, as for hints, so their outcomes are often "unclear". A
+// whole game costs about as much as a hint, so it counts against the
+// same per-user limit.
+func handleGameAnalysis(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		jsonError(w, "Room ID required", http.StatusBadRequest)
+		return
+	}
+
+	if !hintLimiter.allow(user.ID, time.Now().UTC()) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(hintLimiter.window.Seconds())))
+		jsonErrorCode(w, "rate_limited", "Too many analyses, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	games.mu.RLock()
+	room := games.rooms[roomID]
+	if room == nil {
+		games.mu.RUnlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	// Analysing a game in progress would be a hint for both players
+	if room.Status != "finished" {
+		games.mu.RUnlock()
+		jsonErrorCode(w, "game_not_finished", "Only finished games can be analysed", http.StatusConflict)
+		return
+	}
+	if !boardMatchesSize(room) {
+		games.mu.RUnlock()
+		jsonErrorCode(w, errBoardMisconfigured.Code, errBoardMisconfigured.Message, http.StatusInternalServerError)
+		return
+	}
+	final := append([]string(nil), room.Board...)
+	moves := append([]int(nil), room.Moves...)
+	size := room.BoardSize
+	conditions := winConditions(room)
+	games.mu.RUnlock()
+
+	// Search outside the lock, replaying on a board of our own. Turns
+	// can be skipped, so each move's symbol comes from the final board.
+	board := make([]string, len(final))
+	annotations := make([]moveAnnotation, 0, len(moves))
+	for i, idx := range moves {
+		symbol := final[idx]
+		search := newSearcher(board, size, conditions)
+		exhaustive := search.exhaustive()
+
+		best, bestScore := search.search(symbol)
+		played := bestScore
+		if idx != best {
+			played = search.scoreMove(symbol, idx)
+		}
+
+		note := moveAnnotation{
+			Ply:         i + 1,
+			Index:       idx,
+			Symbol:      symbol,
+			Outcome:     searchOutcome(played, exhaustive),
+			BestIndex:   best,
+			BestOutcome: searchOutcome(bestScore, exhaustive),
+		}
+		note.Blunder = outcomeRank[note.BestOutcome] > outcomeRank[note.Outcome]
+		annotations = append(annotations, note)
+
+		board[idx] = symbol
+	}
+
+	jsonResponse(w, map[string]interface{}{
+		"room_id": roomID,
+		"moves":   annotations,
+	})
+}
+
+// hintsBlocked reports whether the room refuses move help right now:
+// rooms created with hints_disabled allow none until the game is over
+func hintsBlocked(room *GameRoom) bool {
+	return room.HintsDisabled && room.Status == "playing"
+}
+
+// handleGameThreats lists, for each player, the cells that would win the
+// game for them if played now
+func handleGameThreats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		jsonError(w, "Room ID required", http.StatusBadRequest)
+		return
+	}
+
+	games.mu.RLock()
+	room := games.rooms[roomID]
+	if room == nil {
+		games.mu.RUnlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	if hintsBlocked(room) {
+		games.mu.RUnlock()
+		jsonErrorCode(w, "hints_disabled", "Hints are disabled in this game", http.StatusForbidden)
+		return
+	}
+	if !boardMatchesSize(room) {
+		games.mu.RUnlock()
+		jsonErrorCode(w, errBoardMisconfigured.Code, errBoardMisconfigured.Message, http.StatusInternalServerError)
+		return
+	}
+	threats := map[string][]int{
+		"X": winningCells(room.Board, winConditions(room), "X"),
+		"O": winningCells(room.Board, winConditions(room), "O"),
+	}
+	games.mu.RUnlock()
+
+	jsonResponse(w, threats)
+}
+
+// maxEvaluateCandidates caps the cells one evaluate request can ask about
+const maxEvaluateCandidates = 64
+
+// moveEvaluation describes one candidate cell for the player to move
+type moveEvaluation struct {
+	Index  int    `json:"index"`
+	Legal  bool   `json:"legal"`
+	Reason string `json:"reason,omitempty"` // move error code when not legal
+	Wins   bool   `json:"wins"`             // completes a line for the player to move
+	Blocks bool   `json:"blocks"`           // takes a cell the opponent would win on
+}
+
+// handleEvaluateMoves reports, for each candidate cell, whether the player
+// to move could play it and whether it would win or block a threat
+func handleEvaluateMoves(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RoomID  string `json:"room_id" validate:"required"`
+		Indices []int  `json:"indices"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Indices) == 0 || len(req.Indices) > maxEvaluateCandidates {
+		jsonErrorCode(w, "invalid_field", fmt.Sprintf("indices must list 1 to %d cells", maxEvaluateCandidates), http.StatusBadRequest)
+		return
+	}
+
+	games.mu.RLock()
+	room := games.rooms[req.RoomID]
+	if room == nil {
+		games.mu.RUnlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	if hintsBlocked(room) {
+		games.mu.RUnlock()
+		jsonErrorCode(w, "hints_disabled", "Hints are disabled in this game", http.StatusForbidden)
+		return
+	}
+	if !boardMatchesSize(room) {
+		games.mu.RUnlock()
+		jsonErrorCode(w, errBoardMisconfigured.Code, errBoardMisconfigured.Message, http.StatusInternalServerError)
+		return
+	}
+
+	conditions := winConditions(room)
+	wins := map[int]bool{}
+	for _, idx := range winningCells(room.Board, conditions, room.CurrentTurn) {
+		wins[idx] = true
+	}
+	blocks := map[int]bool{}
+	for _, idx := range winningCells(room.Board, conditions, otherSymbol(room.CurrentTurn)) {
+		blocks[idx] = true
+	}
+
+	evaluations := make([]moveEvaluation, 0, len(req.Indices))
+	for _, idx := range req.Indices {
+		eval := moveEvaluation{Index: idx}
+		switch {
+		case room.Status != "playing":
+			eval.Reason = notPlayingError(room).Code
+		case room.Paused:
+			eval.Reason = errGamePaused.Code
+		case idx < 0 || idx >= len(room.Board):
+			eval.Reason = errInvalidPosition.Code
+		case room.Board[idx] != "":
+			eval.Reason = errCellTaken.Code
+		default:
+			eval.Legal = true
+			eval.Wins = wins[idx]
+			eval.Blocks = blocks[idx]
+		}
+		evaluations = append(evaluations, eval)
+	}
+	turn := room.CurrentTurn
+	games.mu.RUnlock()
+
+	jsonResponse(w, map[string]interface{}{
+		"current_turn": turn,
+		"evaluations":  evaluations,
+	})
+}
+
+// handleRecentGames lists recently finished games, newest first. An
+// optional limit caps how many are returned (default 20).
+func handleRecentGames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 20
+	if param := r.URL.Query().Get("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > recentGamesCap {
+			jsonError(w, fmt.Sprintf("limit must be between 1 and %d", recentGamesCap), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	games.mu.RLock()
+	feed := make([]RecentGame, 0, limit)
+	for i := len(games.recent) - 1; i >= 0 && len(feed) < limit; i-- {
+		feed = append(feed, games.recent[i])
+	}
+	games.mu.RUnlock()
+
+	jsonResponse(w, feed)
+}
+
+// handleCurrentGame returns the room the user is waiting in or playing, so
+// a reconnecting client can find its game without the room ID
+func handleCurrentGame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	games.mu.RLock()
+	var current *GameRoom
+	var state gameStateResponse
+	for _, room := range games.rooms {
+		if room.Status != "waiting" && room.Status != "ready_check" && room.Status != "playing" {
+			continue
+		}
+		if playerSymbol(room, user.ID) == "" {
+			continue
+		}
+		// Prefer the most recently active room if there are several
+		if current == nil || room.UpdatedAt.After(current.UpdatedAt) {
+			current = room
+		}
+	}
+	if current != nil {
+		state = gameStateFor(current, user)
+	}
+	games.mu.RUnlock()
+
+	if current == nil {
+		jsonError(w, "No active game", http.StatusNotFound)
+		return
+	}
+
+	jsonResponse(w, state)
+}
+
+// handleGameMove processes a player's move
+func handleGameMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// The cell is given either as an index or as a zero-based row and
+	// column. An expected_version, if given, must match the room's version.
+	var req struct {
+		RoomID          string `json:"room_id" validate:"required"`
+		Index           *int   `json:"index"`
+		Row             *int   `json:"row"`
+		Col             *int   `json:"col"`
+		ExpectedVersion *int   `json:"expected_version"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if req.Index == nil && (req.Row == nil || req.Col == nil) {
+		jsonError(w, "Either index or row and col are required", http.StatusBadRequest)
+		return
+	}
+
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
+	if room == nil {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	// A client that moved from an outdated board gets the current state
+	// back to resync from, rather than a confusing rejection
+	if req.ExpectedVersion != nil && *req.ExpectedVersion != room.Version {
+		state := gameStateFor(room, user)
+		games.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		newJSONEncoder(w).Encode(map[string]interface{}{
+			"error": "Game has changed since your last update",
+			"code":  "stale_state",
+			"state": state,
+		})
+		return
+	}
+
+	index := -1
+	if req.Index != nil {
+		index = *req.Index
+	} else if *req.Row >= 0 && *req.Row < room.BoardSize && *req.Col >= 0 && *req.Col < room.BoardSize {
+		index = rowColToIndex(*req.Row, *req.Col, room.BoardSize)
+	}
+
+	// With move confirmation on, a move only becomes pending
+	if room.ConfirmMoves {
+		err := proposeMove(room, user.ID, index)
+		writeMoveResult(w, room, user, err)
+		return
+	}
+
+	err := applyMove(room, user.ID, index)
+	writeMoveResult(w, room, user, err)
+}
+
+// handleConfirmMove commits the caller's pending move in a room with
+// ConfirmMoves
+func handleConfirmMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req struct {
+		RoomID string `json:"room_id" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
+	if room == nil {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	// The pending move always belongs to the player to move
+	if room.pendingMove == nil || room.CurrentTurn != playerSymbol(room, user.ID) {
+		games.mu.Unlock()
+		jsonErrorCode(w, "no_pending_move", "No move to confirm", http.StatusBadRequest)
+		return
+	}
+
+	err := applyMove(room, user.ID, *room.pendingMove)
+	writeMoveResult(w, room, user, err)
+}
+
+// handleUndoMove takes back the last move in a practice game. Either
+// player may undo, without the other's consent, even after the game ends.
+func handleUndoMove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req struct {
+		RoomID string `json:"room_id" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
+	if room == nil {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	if playerSymbol(room, user.ID) == "" {
+		games.mu.Unlock()
+		jsonErrorCode(w, errNotInGame.Code, errNotInGame.Message, http.StatusForbidden)
+		return
+	}
+	if room.Mode != "practice" {
+		games.mu.Unlock()
+		jsonErrorCode(w, "undo_not_allowed", "Moves can only be undone in practice games", http.StatusBadRequest)
+		return
+	}
+	// A forfeit can't be undone: the forfeiter has left or run out of time
+	if (room.Status != "playing" && room.Status != "finished") || room.ForfeitedBy != "" || len(room.Moves) == 0 {
+		games.mu.Unlock()
+		jsonErrorCode(w, "nothing_to_undo", "There is no move to undo", http.StatusBadRequest)
+		return
+	}
+
+	undoMove(room)
+	state := gameStateFor(room, user)
+	games.mu.Unlock()
 
-// checkWinner checks if there's a winner
-func checkWinner(board []string, size int) (string, []int) {
-	conditions := generateWinningConditions(size)
+	logf(r, "Game %s: %s undid the last move", room.Code, user.Username)
 
-	for _, condition := range conditions {
-		first := board[condition[0]]
-		if first == "" {
-			continue
-		}
+	jsonResponse(w, state)
+}
 
-		won := true
-		for _, idx := range condition {
-			if board[idx] != first {
-				won = false
-				break
-			}
-		}
+// undoMove takes back the last move, along with any turns skipped after
+// it, reopening the game if it had ended, and gives the turn back to
+// whoever made it. The caller must hold games.mu.
+func undoMove(room *GameRoom) {
+	last := room.Moves[len(room.Moves)-1]
+	room.Moves = room.Moves[:len(room.Moves)-1]
+	room.CurrentTurn = room.Board[last]
+	room.Board[last] = ""
+
+	// Skips are recorded in order, so the ones to drop are at the end
+	skips := room.SkippedTurns
+	for len(skips) > 0 && skips[len(skips)-1].AfterMove > len(room.Moves) {
+		skips = skips[:len(skips)-1]
+	}
+	room.SkippedTurns = skips
 
-		if won {
-			return first, condition
-		}
+	room.LastMove, room.LastMoveBy = -1, ""
+	if n := len(room.Moves); n > 0 {
+		room.LastMove = room.Moves[n-1]
+		room.LastMoveBy = room.Board[room.LastMove]
 	}
 
-	return "", nil
+	room.Status = "playing"
+	room.Winner = ""
+	room.WinningLine = nil
+	room.FinishedAt = time.Time{}
+	room.WinRevealAt = time.Time{}
+	room.pendingMove = nil
+
+	now := time.Now().UTC()
+	room.TurnStartedAt = now
+	touchRoom(room, now)
 }
 
-// checkDraw checks if the game is a draw
-func checkDraw(board []string) bool {
-	for _, cell := range board {
-		if cell == "" {
-			return false
+// writeMoveResult responds to a move request with the error from applying
+// it, or the new state. The caller must hold games.mu, which is released.
+func writeMoveResult(w http.ResponseWriter, room *GameRoom, user *User, err error) {
+	if err != nil {
+		if err == errTimeExpired {
+			recordResult(room)
+			persistResult(room)
+		}
+		winner := room.Winner
+		games.mu.Unlock()
+		moveErr := err.(*MoveError)
+		if moveErr == errGameOver {
+			// Include the result so a move that lost the race to the
+			// winning one can show it without another poll
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			newJSONEncoder(w).Encode(map[string]string{"error": moveErr.Message, "code": moveErr.Code, "winner": winner})
+			return
+		}
+		status := http.StatusBadRequest
+		switch moveErr {
+		case errNotInGame:
+			status = http.StatusForbidden
+		case errMissingPlayer, errSamePlayer, errGamePaused:
+			status = http.StatusConflict
+		case errCorruptRoom, errBoardMisconfigured:
+			status = http.StatusInternalServerError
 		}
+		jsonErrorCode(w, moveErr.Code, moveErr.Message, status)
+		return
 	}
-	return true
-}
 
-// ==================== User Management Handlers ====================
+	// Persisted tells the client whether the result made it to disk
+	persisted := true
+	if room.Status == "finished" {
+		recordResult(room)
+		persisted = persistResult(room)
+	}
 
-// handleRegister creates a new user
-func handleRegister(w http.ResponseWriter, r *http.Request) {
+	state := gameStateFor(room, user)
+	state.Persisted = &persisted
+	state.Warnings = moveWarnings(room, playerSymbol(room, user.ID))
+	games.mu.Unlock()
+
+	jsonResponse(w, state)
+}
+
+// handleLeaveGame removes a player from a game
+func handleLeaveGame(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
 	var req struct {
-		Username string `json:"username"`
+		RoomID string `json:"room_id"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	if req.Username == "" || len(req.Username) < 2 || len(req.Username) > 20 {
-		jsonError(w, "Username must be 2-20 characters", http.StatusBadRequest)
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
+	if room == nil {
+		games.mu.Unlock()
+		jsonResponse(w, map[string]string{"status": "ok"})
 		return
 	}
 
-	// Check if username exists
-	if findUserByUsername(req.Username) != nil {
-		jsonError(w, "Username already taken", http.StatusConflict)
+	// If game is waiting, just delete it
+	if room.Status == "waiting" {
+		delete(games.codes, room.Code)
+		delete(games.rooms, room.ID)
+		games.mu.Unlock()
+		jsonResponse(w, map[string]string{"status": "ok"})
 		return
 	}
 
-	// Create new user
-	user := &User{
-		ID:        generateID(),
-		Username:  req.Username,
-		Scores:    Scores{},
-		CreatedAt: time.Now(),
+	symbol := playerSymbol(room, user.ID)
+	if symbol == "" {
+		games.mu.Unlock()
+		jsonError(w, "You are not in this game", http.StatusForbidden)
+		return
 	}
 
-	db.mu.Lock()
-	db.Users[user.ID] = user
-	db.mu.Unlock()
+	// A finished room is kept for a short while so that a player still
+	// polling sees the result, even if both left at once (the first
+	// leave forfeiting the game). Leaving again is harmless.
+	if room.Status == "finished" || room.Status == "cancelled" || room.Status == "abandoned" {
+		if room.departed == nil {
+			room.departed = make(map[string]bool)
+		}
+		room.departed[user.ID] = true
+		if time.Since(room.FinishedAt) > finishedRetention {
+			delete(games.codes, room.Code)
+			delete(games.rooms, room.ID)
+		}
+		games.mu.Unlock()
+		jsonResponse(w, map[string]string{"status": "ok"})
+		return
+	}
+
+	// Nobody has moved before the ready check passes, so leaving then
+	// cancels the game unscored
+	if room.Status == "ready_check" {
+		cancelGame(room)
+		games.mu.Unlock()
+		logf(r, "Game %s: %s left during the ready check", room.Code, user.Username)
+		jsonResponse(w, map[string]string{"status": "ok"})
+		return
+	}
 
-	if err := saveDatabase(); err != nil {
-		log.Printf("Error saving database: %v", err)
+	// A game in progress should always have both players, but don't trust
+	// it: with no opponent to award the win to, discard the room unscored
+	// and say so, rather than report an ordinary leave
+	opponent := room.PlayerO
+	if symbol == "O" {
+		opponent = room.PlayerX
+	}
+	if opponent == nil {
+		delete(games.codes, room.Code)
+		delete(games.rooms, room.ID)
+		games.mu.Unlock()
+		logf(r, "Game %s: discarded in-progress game with no opponent", room.Code)
+		jsonErrorCode(w, "opponent_missing", "Game had no opponent and was discarded", http.StatusConflict)
+		return
 	}
 
-	// Create session
-	token := generateToken()
-	sessions.mu.Lock()
-	sessions.sessions[token] = user.ID
-	sessions.mu.Unlock()
+	// If game is in progress, the leaving player forfeits
+	forfeitGame(room, symbol)
+	recordResult(room)
+	persistResult(room)
 
-	jsonResponse(w, map[string]interface{}{
-		"user":  user,
-		"token": token,
-	})
+	games.mu.Unlock()
+	jsonResponse(w, map[string]string{"status": "ok"})
 }
 
-// handleLogin logs in an existing user
-func handleLogin(w http.ResponseWriter, r *http.Request) {
+// handleCancelGame lets the host delete a room nobody has joined yet
+func handleCancelGame(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	user := requireUser(w, r)
+	if user == nil {
+		return
+	}
+
 	var req struct {
-		Username string `json:"username"`
+		Code string `json:"code" validate:"required"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	user := findUserByUsername(req.Username)
-	if user == nil {
-		jsonError(w, "User not found", http.StatusNotFound)
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+
+	games.mu.Lock()
+	room := games.rooms[games.codes[code]]
+	if room == nil {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
 		return
 	}
 
-	// Create session
-	token := generateToken()
-	sessions.mu.Lock()
-	sessions.sessions[token] = user.ID
-	sessions.mu.Unlock()
+	if room.PlayerX == nil || room.PlayerX.ID != user.ID {
+		games.mu.Unlock()
+		jsonError(w, "Only the host can cancel this game", http.StatusForbidden)
+		return
+	}
 
-	jsonResponse(w, map[string]interface{}{
-		"user":  user,
-		"token": token,
-	})
+	if room.Status != "waiting" {
+		games.mu.Unlock()
+		jsonError(w, "Game has already started", http.StatusConflict)
+		return
+	}
+
+	delete(games.codes, room.Code)
+	delete(games.rooms, room.ID)
+	games.mu.Unlock()
+
+	logf(r, "Game %s: cancelled by %s", code, user.Username)
+
+	jsonResponse(w, map[string]string{"status": "ok"})
 }
 
-// handleLogout logs out a user
-func handleLogout(w http.ResponseWriter, r *http.Request) {
+// handleNewGameCode gives a waiting room a fresh join code, so a leaked
+// code stops working
+func handleNewGameCode(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	token := r.Header.Get("Authorization")
-	if token != "" {
-		sessions.mu.Lock()
-		delete(sessions.sessions, token)
-		sessions.mu.Unlock()
+	user := requireUser(w, r)
+	if user == nil {
+		return
 	}
 
-	jsonResponse(w, map[string]string{"status": "ok"})
-}
+	var req struct {
+		RoomID string `json:"room_id" validate:"required"`
+	}
 
-// handleGetUser returns current user info
-func handleGetUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	user := getUserFromToken(r)
-	if user == nil {
-		jsonError(w, "Not authenticated", http.StatusUnauthorized)
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
+	if room == nil {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
 		return
 	}
 
-	jsonResponse(w, user)
+	if room.PlayerX == nil || room.PlayerX.ID != user.ID {
+		games.mu.Unlock()
+		jsonError(w, "Only the host can change the join code", http.StatusForbidden)
+		return
+	}
+
+	if room.Status != "waiting" {
+		games.mu.Unlock()
+		jsonError(w, "Game has already started", http.StatusConflict)
+		return
+	}
+
+	oldCode := room.Code
+	delete(games.codes, oldCode)
+	room.Code = uniqueGameCode()
+	games.codes[room.Code] = room.ID
+	touchRoom(room, time.Now().UTC())
+	state := gameStateFor(room, user)
+	games.mu.Unlock()
+
+	logf(r, "Game %s: join code changed to %s by %s", oldCode, room.Code, user.Username)
+
+	jsonResponse(w, state)
 }
 
-// handleUpdateScore updates user's score
-func handleUpdateScore(w http.ResponseWriter, r *http.Request) {
+// handleTransferHost removes the host from a waiting room without closing
+// it. The room is kept open and whoever joins next becomes the host; the
+// code stays the same. Nobody else is in a waiting room, so there is no
+// one to hand it to directly.
+func handleTransferHost(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	user := getUserFromToken(r)
+	user := requireUser(w, r)
 	if user == nil {
-		jsonError(w, "Not authenticated", http.StatusUnauthorized)
 		return
 	}
 
 	var req struct {
-		Result string `json:"result"` // "win", "loss", or "draw"
+		RoomID string `json:"room_id" validate:"required"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	db.mu.Lock()
-	switch req.Result {
-	case "win":
-		user.Scores.Wins++
-	case "loss":
-		user.Scores.Losses++
-	case "draw":
-		user.Scores.Draws++
-	default:
-		db.mu.Unlock()
-		jsonError(w, "Invalid result type", http.StatusBadRequest)
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
+	if room == nil {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
 		return
 	}
-	db.mu.Unlock()
-
-	if err := saveDatabase(); err != nil {
-		log.Printf("Error saving database: %v", err)
-	}
 
-	jsonResponse(w, user)
-}
-
-// handleLeaderboard returns top players
-func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if room.PlayerX == nil || room.PlayerX.ID != user.ID {
+		games.mu.Unlock()
+		jsonError(w, "Only the host can transfer this game", http.StatusForbidden)
 		return
 	}
 
-	db.mu.RLock()
-	users := make([]*User, 0, len(db.Users))
-	for _, user := range db.Users {
-		users = append(users, user)
+	if room.Status != "waiting" {
+		games.mu.Unlock()
+		jsonError(w, "Game has already started", http.StatusConflict)
+		return
 	}
-	db.mu.RUnlock()
 
-	// Sort by wins (simple bubble sort for small lists)
-	for i := 0; i < len(users)-1; i++ {
-		for j := 0; j < len(users)-i-1; j++ {
-			if users[j].Scores.Wins < users[j+1].Scores.Wins {
-				users[j], users[j+1] = users[j+1], users[j]
-			}
-		}
-	}
+	room.PlayerX = nil
+	touchRoom(room, time.Now().UTC())
+	games.mu.Unlock()
 
-	// Return top 10
-	limit := 10
-	if len(users) < limit {
-		limit = len(users)
-	}
+	logf(r, "Game %s: %s left, next joiner becomes host", room.Code, user.Username)
 
-	jsonResponse(w, users[:limit])
+	jsonResponse(w, map[string]string{"status": "ok"})
 }
 
-// ==================== Game Room Handlers ====================
+// startGame begins play, with X to move
+func startGame(room *GameRoom, now time.Time) {
+	room.Status = "playing"
+	room.StartedAt = now
+	room.TurnStartedAt = now
+}
 
-// handleCreateGame creates a new game room
-func handleCreateGame(w http.ResponseWriter, r *http.Request) {
+// handleGameReady confirms the caller is ready in a room's ready check.
+// Play starts once both players have confirmed.
+func handleGameReady(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	user := getUserFromToken(r)
+	user := requireUser(w, r)
 	if user == nil {
-		jsonError(w, "Not authenticated", http.StatusUnauthorized)
 		return
 	}
 
 	var req struct {
-		BoardSize int `json:"board_size"`
+		RoomID string `json:"room_id" validate:"required"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	if req.BoardSize != 3 && req.BoardSize != 5 {
-		req.BoardSize = 3
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
+	if room == nil {
+		games.mu.Unlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
 	}
 
-	// Generate unique code
-	var code string
-	games.mu.Lock()
-	for {
-		code = generateGameCode()
-		if _, exists := games.codes[code]; !exists {
-			break
-		}
+	symbol := playerSymbol(room, user.ID)
+	if symbol == "" {
+		games.mu.Unlock()
+		jsonErrorCode(w, errNotInGame.Code, errNotInGame.Message, http.StatusForbidden)
+		return
 	}
 
-	room := &GameRoom{
-		ID:          generateID(),
-		Code:        code,
-		BoardSize:   req.BoardSize,
-		Board:       make([]string, req.BoardSize*req.BoardSize),
-		PlayerX:     user,
-		PlayerO:     nil,
-		CurrentTurn: "X",
-		Status:      "waiting",
-		Winner:      "",
-		WinningLine: nil,
-		LastMove:    -1,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+	expireReadyCheck(room)
+	if room.Status != "ready_check" {
+		games.mu.Unlock()
+		jsonErrorCode(w, "no_ready_check", "Game is not waiting for players to be ready", http.StatusConflict)
+		return
 	}
 
-	games.rooms[room.ID] = room
-	games.codes[code] = room.ID
+	if symbol == "X" {
+		room.ReadyX = true
+	} else {
+		room.ReadyO = true
+	}
+	now := time.Now().UTC()
+	if room.ReadyX && room.ReadyO {
+		startGame(room, now)
+		logf(r, "Game %s: both players ready", room.Code)
+	}
+	touchRoom(room, now)
+
+	state := gameStateFor(room, user)
 	games.mu.Unlock()
 
-	log.Printf("Game created: %s by %s", code, user.Username)
+	jsonResponse(w, state)
+}
 
-	jsonResponse(w, room)
+// handlePauseGame asks to pause a game in progress. The game pauses once
+// both players have asked.
+func handlePauseGame(w http.ResponseWriter, r *http.Request) {
+	votePause(w, r, true)
 }
 
-// handleJoinGame joins an existing game room
-func handleJoinGame(w http.ResponseWriter, r *http.Request) {
+// handleResumeGame asks to resume a paused game. Play resumes once both
+// players have asked.
+func handleResumeGame(w http.ResponseWriter, r *http.Request) {
+	votePause(w, r, false)
+}
+
+// votePause records the caller's request to pause (or resume) a game, and
+// pauses (or resumes) it if the opponent already asked for the same.
+// While paused the turn timer and clock stand still; resuming shifts the
+// turn's start forward by the time spent paused.
+func votePause(w http.ResponseWriter, r *http.Request, pause bool) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	user := getUserFromToken(r)
+	user := requireUser(w, r)
 	if user == nil {
-		jsonError(w, "Not authenticated", http.StatusUnauthorized)
 		return
 	}
 
 	var req struct {
-		Code string `json:"code"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid request body", http.StatusBadRequest)
-		return
+		RoomID string `json:"room_id" validate:"required"`
 	}
-
-	code := strings.ToUpper(strings.TrimSpace(req.Code))
-
-	games.mu.Lock()
-	roomID, exists := games.codes[code]
-	if !exists {
-		games.mu.Unlock()
-		jsonError(w, "Game not found", http.StatusNotFound)
+
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	room := games.rooms[roomID]
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
 	if room == nil {
 		games.mu.Unlock()
 		jsonError(w, "Game not found", http.StatusNotFound)
 		return
 	}
 
-	// Check if user is already in this game
-	if room.PlayerX != nil && room.PlayerX.ID == user.ID {
+	symbol := playerSymbol(room, user.ID)
+	if symbol == "" {
 		games.mu.Unlock()
-		jsonResponse(w, room)
+		jsonErrorCode(w, errNotInGame.Code, errNotInGame.Message, http.StatusForbidden)
 		return
 	}
 
-	if room.PlayerO != nil && room.PlayerO.ID == user.ID {
+	// A timer that ran out before the request still ends the game
+	if checkTimers(room) {
+		recordResult(room)
+		persistResult(room)
+	}
+	if room.Status != "playing" {
+		moveErr := notPlayingError(room)
 		games.mu.Unlock()
-		jsonResponse(w, room)
+		jsonErrorCode(w, moveErr.Code, moveErr.Message, http.StatusBadRequest)
 		return
 	}
-
-	// Check if game is full
-	if room.PlayerO != nil {
+	if room.Paused == pause {
 		games.mu.Unlock()
-		jsonError(w, "Game is full", http.StatusConflict)
+		if pause {
+			jsonErrorCode(w, "already_paused", "Game is already paused", http.StatusConflict)
+		} else {
+			jsonErrorCode(w, "not_paused", "Game is not paused", http.StatusConflict)
+		}
 		return
 	}
 
-	// Join as player O
-	room.PlayerO = user
-	room.Status = "playing"
-	room.UpdatedAt = time.Now()
-	games.mu.Unlock()
+	now := time.Now().UTC()
+	if room.PauseRequestBy == "" || room.PauseRequestBy == symbol {
+		room.PauseRequestBy = symbol
+	} else {
+		room.PauseRequestBy = ""
+		if pause {
+			room.Paused = true
+			room.PausedAt = now
+		} else {
+			room.TurnStartedAt = room.TurnStartedAt.Add(now.Sub(room.PausedAt))
+			room.Paused = false
+			room.PausedAt = time.Time{}
+		}
+		logf(r, "Game %s: paused=%v", room.Code, room.Paused)
+	}
+	touchRoom(room, now)
 
-	log.Printf("Game %s: %s joined as O", code, user.Username)
+	state := gameStateFor(room, user)
+	games.mu.Unlock()
 
-	jsonResponse(w, room)
+	jsonResponse(w, state)
 }
 
-// handleGameState returns current game state
-func handleGameState(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+// handleGameEmote triggers an emote for both players to see
+func handleGameEmote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	roomID := r.URL.Query().Get("room_id")
-	if roomID == "" {
-		jsonError(w, "Room ID required", http.StatusBadRequest)
+	user := requireUser(w, r)
+	if user == nil {
 		return
 	}
 
-	games.mu.Lock()
-	room := games.rooms[roomID]
-	if room != nil {
-		// Auto-clear emote after 3 seconds
-		if room.ShowEmote && time.Since(room.EmoteAt) > 3*time.Second {
-			room.ShowEmote = false
-			room.EmoteType = ""
-			room.EmoteBy = ""
-		}
+	var req struct {
+		RoomID    string `json:"room_id" validate:"required"`
+		EmoteType string `json:"emote_type" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if !isKnownEmote(req.EmoteType) {
+		jsonError(w, "Unknown emote type", http.StatusBadRequest)
+		return
 	}
-	games.mu.Unlock()
 
+	games.mu.Lock()
+	room := games.rooms[req.RoomID]
 	if room == nil {
+		games.mu.Unlock()
 		jsonError(w, "Game not found", http.StatusNotFound)
 		return
 	}
 
-	jsonResponse(w, room)
+	// Verify user is in this game
+	isInGame := (room.PlayerX != nil && room.PlayerX.ID == user.ID) ||
+		(room.PlayerO != nil && room.PlayerO.ID == user.ID)
+	if !isInGame {
+		games.mu.Unlock()
+		jsonError(w, "You are not in this game", http.StatusForbidden)
+		return
+	}
+
+	// Set the emote
+	room.ShowEmote = true
+	room.EmoteType = req.EmoteType
+	room.EmoteBy = user.Username
+	room.EmoteAt = time.Now().UTC()
+	touchRoom(room, room.EmoteAt)
+
+	snapshot := snapshotRoom(room)
+	games.mu.Unlock()
+
+	logf(r, "Game %s: %s triggered emote %s", room.Code, user.Username, req.EmoteType)
+
+	jsonResponse(w, snapshot)
 }
 
-// handleGameMove processes a player's move
-func handleGameMove(w http.ResponseWriter, r *http.Request) {
+// handleClearEmote dismisses the caller's emote before it would clear on
+// its own. Only the player who sent the emote can clear it.
+func handleClearEmote(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	user := getUserFromToken(r)
+	user := requireUser(w, r)
 	if user == nil {
-		jsonError(w, "Not authenticated", http.StatusUnauthorized)
 		return
 	}
 
 	var req struct {
-		RoomID string `json:"room_id"`
-		Index  int    `json:"index"`
+		RoomID string `json:"room_id" validate:"required"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
@@ -738,220 +4518,410 @@ func handleGameMove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify game is in progress
-	if room.Status != "playing" {
+	if playerSymbol(room, user.ID) == "" {
 		games.mu.Unlock()
-		jsonError(w, "Game is not in progress", http.StatusBadRequest)
+		jsonError(w, "You are not in this game", http.StatusForbidden)
 		return
 	}
 
-	// Verify it's this player's turn
-	var playerSymbol string
-	if room.PlayerX != nil && room.PlayerX.ID == user.ID {
-		playerSymbol = "X"
-	} else if room.PlayerO != nil && room.PlayerO.ID == user.ID {
-		playerSymbol = "O"
-	} else {
-		games.mu.Unlock()
-		jsonError(w, "You are not in this game", http.StatusForbidden)
-		return
+	// Nothing showing is already the state the caller wants
+	if room.ShowEmote {
+		if room.EmoteBy != user.Username {
+			games.mu.Unlock()
+			jsonErrorCode(w, "not_your_emote", "Only the player who sent an emote can clear it", http.StatusForbidden)
+			return
+		}
+		room.ShowEmote = false
+		room.EmoteType = ""
+		room.EmoteBy = ""
+		touchRoom(room, time.Now().UTC())
 	}
 
-	if room.CurrentTurn != playerSymbol {
-		games.mu.Unlock()
-		jsonError(w, "Not your turn", http.StatusBadRequest)
-		return
+	snapshot := snapshotRoom(room)
+	games.mu.Unlock()
+
+	jsonResponse(w, snapshot)
+}
+
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// decodeBody decodes a JSON or form-encoded request body into v.
+// Bodies without a Content-Type are treated as JSON; any other type is
+// rejected with errUnsupportedMediaType.
+func decodeBody(r *http.Request, v interface{}) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return json.NewDecoder(r.Body).Decode(v)
 	}
 
-	// Verify move is valid
-	if req.Index < 0 || req.Index >= len(room.Board) {
-		games.mu.Unlock()
-		jsonError(w, "Invalid move position", http.StatusBadRequest)
-		return
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		return json.NewDecoder(r.Body).Decode(v)
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+		return decodeForm(r.PostForm, v)
 	}
+	return errUnsupportedMediaType
+}
 
-	if room.Board[req.Index] != "" {
-		games.mu.Unlock()
-		jsonError(w, "Cell already taken", http.StatusBadRequest)
-		return
+// decodeForm copies form values into the fields of the struct pointed to
+// by v, matching form keys against the fields' json tags
+func decodeForm(form url.Values, v interface{}) error {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || !form.Has(name) {
+			continue
+		}
+		if err := setFormField(rv.Field(i), form.Get(name)); err != nil {
+			return fmt.Errorf("field %q: %v", name, err)
+		}
 	}
+	return nil
+}
 
-	// Make the move
-	room.Board[req.Index] = playerSymbol
-	room.LastMove = req.Index
-	room.UpdatedAt = time.Now()
+// setFormField parses a form value into a string, int, or bool field
+func setFormField(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		if err := setFormField(ptr.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
 
-	// Check for winner
-	winner, winningLine := checkWinner(room.Board, room.BoardSize)
-	if winner != "" {
-		room.Winner = winner
-		room.WinningLine = winningLine
-		room.Status = "finished"
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
 
-		// Update scores
-		if winner == "X" && room.PlayerX != nil {
-			room.PlayerX.Scores.Wins++
-			if room.PlayerO != nil {
-				room.PlayerO.Scores.Losses++
-			}
-		} else if winner == "O" && room.PlayerO != nil {
-			room.PlayerO.Scores.Wins++
-			if room.PlayerX != nil {
-				room.PlayerX.Scores.Losses++
-			}
+// decodeErrorMessage describes why a request body could not be decoded
+func decodeErrorMessage(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "Empty request body"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "Malformed JSON: unexpected end of body"
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("Malformed JSON at byte %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fmt.Sprintf("Field '%s' must be %s", typeErr.Field, jsonKindName(typeErr.Type))
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("Request body must be %s", jsonKindName(typeErr.Type))
+	}
+	return "Invalid request body"
+}
+
+// jsonKindName names the JSON value expected for a Go type
+func jsonKindName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a " + t.String()
+}
+
+// decodeRequest decodes and validates a request body into v, writing a
+// 400 response and returning false if either step fails
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := decodeBody(r, v); err != nil {
+		if err == errUnsupportedMediaType {
+			jsonError(w, "Content-Type must be application/json or application/x-www-form-urlencoded", http.StatusUnsupportedMediaType)
+		} else {
+			jsonError(w, decodeErrorMessage(err), http.StatusBadRequest)
 		}
-		saveDatabase()
-	} else if checkDraw(room.Board) {
-		room.Winner = "draw"
-		room.Status = "finished"
+		return false
+	}
 
-		// Update scores
-		if room.PlayerX != nil {
-			room.PlayerX.Scores.Draws++
+	if fieldErr := validateStruct(v); fieldErr != nil {
+		jsonFieldError(w, "invalid_field", fieldErr.Field, fieldErr.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// FieldError reports which request field failed validation
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// validateStruct checks the fields of the struct pointed to by v against
+// their validate tags. Supported rules are required, min=N and max=N
+// (length for strings, value for ints), and oneof=a b c. A leading
+// omitempty skips the remaining rules for zero values.
+func validateStruct(v interface{}) *FieldError {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		tag := rt.Field(i).Tag.Get("validate")
+		if tag == "" {
+			continue
 		}
-		if room.PlayerO != nil {
-			room.PlayerO.Scores.Draws++
+		name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		field := rv.Field(i)
+
+		if rest, ok := strings.CutPrefix(tag, "omitempty,"); ok {
+			if field.IsZero() {
+				continue
+			}
+			tag = rest
 		}
-		saveDatabase()
-	} else {
-		// Switch turns
-		if room.CurrentTurn == "X" {
-			room.CurrentTurn = "O"
-		} else {
-			room.CurrentTurn = "X"
+
+		for _, rule := range strings.Split(tag, ",") {
+			key, arg, _ := strings.Cut(rule, "=")
+			if msg := checkRule(field, key, arg); msg != "" {
+				return &FieldError{Field: name, Message: msg}
+			}
 		}
 	}
+	return nil
+}
 
-	games.mu.Unlock()
+// checkRule applies a single validation rule, returning a message on failure
+func checkRule(field reflect.Value, key, arg string) string {
+	// A pointer field is set when it is non-nil, even if it points at a
+	// zero value such as index 0
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			if key == "required" {
+				return "is required"
+			}
+			return ""
+		}
+		if key == "required" {
+			return ""
+		}
+		field = field.Elem()
+	}
 
-	jsonResponse(w, room)
+	switch key {
+	case "required":
+		if field.IsZero() {
+			return "is required"
+		}
+	case "min", "max":
+		limit, _ := strconv.Atoi(arg)
+		n := 0
+		unit := ""
+		switch field.Kind() {
+		case reflect.String:
+			n = utf8.RuneCountInString(field.String())
+			unit = " characters"
+		case reflect.Int:
+			n = int(field.Int())
+		}
+		if key == "min" && n < limit {
+			return fmt.Sprintf("must be at least %d%s", limit, unit)
+		}
+		if key == "max" && n > limit {
+			return fmt.Sprintf("must be at most %d%s", limit, unit)
+		}
+	case "oneof":
+		options := strings.Fields(arg)
+		value := fmt.Sprint(field.Interface())
+		for _, option := range options {
+			if value == option {
+				return ""
+			}
+		}
+		return "must be one of: " + strings.Join(options, ", ")
+	}
+	return ""
 }
 
-// handleLeaveGame removes a player from a game
-func handleLeaveGame(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// isKnownEmote reports whether emoteType is in the emotes allowlist
+func isKnownEmote(emoteType string) bool {
+	for _, emote := range emotes {
+		if emote.Type == emoteType {
+			return true
+		}
 	}
+	return false
+}
 
-	user := getUserFromToken(r)
-	if user == nil {
-		jsonError(w, "Not authenticated", http.StatusUnauthorized)
+// handleListEmotes returns the emote types the server accepts
+func handleListEmotes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req struct {
-		RoomID string `json:"room_id"`
-	}
+	jsonResponse(w, emotes)
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid request body", http.StatusBadRequest)
+// handleExportGame returns a room's position for analysis tooling
+func handleExportGame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	games.mu.Lock()
-	room := games.rooms[req.RoomID]
-	if room == nil {
-		games.mu.Unlock()
-		jsonResponse(w, map[string]string{"status": "ok"})
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		jsonError(w, "Room ID required", http.StatusBadRequest)
 		return
 	}
 
-	// If game is waiting or finished, just delete it
-	if room.Status == "waiting" || room.Status == "finished" {
-		delete(games.codes, room.Code)
-		delete(games.rooms, room.ID)
-		games.mu.Unlock()
-		jsonResponse(w, map[string]string{"status": "ok"})
+	games.mu.RLock()
+	room := games.rooms[roomID]
+	if room == nil {
+		games.mu.RUnlock()
+		jsonError(w, "Game not found", http.StatusNotFound)
 		return
 	}
 
-	// If game is in progress, the leaving player forfeits
-	if room.PlayerX != nil && room.PlayerX.ID == user.ID {
-		room.Winner = "O"
-		room.Status = "finished"
-		if room.PlayerO != nil {
-			room.PlayerO.Scores.Wins++
-		}
-		room.PlayerX.Scores.Losses++
-		saveDatabase()
-	} else if room.PlayerO != nil && room.PlayerO.ID == user.ID {
-		room.Winner = "X"
-		room.Status = "finished"
-		if room.PlayerX != nil {
-			room.PlayerX.Scores.Wins++
-		}
-		room.PlayerO.Scores.Losses++
-		saveDatabase()
+	export := map[string]interface{}{
+		"code":       room.Code,
+		"board_size": room.BoardSize,
+		"win_length": room.WinLength,
+		"board":      append([]string(nil), room.Board...),
+		"status":     room.Status,
+		"winner":     room.Winner,
+		"canonical":  canonicalKey(room.Board, room.BoardSize),
 	}
+	games.mu.RUnlock()
 
-	games.mu.Unlock()
-	jsonResponse(w, map[string]string{"status": "ok"})
+	jsonResponse(w, export)
 }
 
-// handleGameEmote triggers an emote for both players to see
-func handleGameEmote(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+// handleAdminGames lists every room with full details, oldest first
+func handleAdminGames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	user := getUserFromToken(r)
-	if user == nil {
-		jsonError(w, "Not authenticated", http.StatusUnauthorized)
+	if !requireAdmin(w, r) {
 		return
 	}
 
-	var req struct {
-		RoomID    string `json:"room_id"`
-		EmoteType string `json:"emote_type"`
+	// Encode while holding the locks: rooms share their boards and
+	// players with live games, which moves keep changing
+	games.mu.RLock()
+	list := make([]*GameRoom, 0, len(games.rooms))
+	for _, room := range games.rooms {
+		list = append(list, room)
 	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "Invalid request body", http.StatusBadRequest)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	db.mu.RLock()
+	encoded, err := json.Marshal(list)
+	db.mu.RUnlock()
+	games.mu.RUnlock()
+	if err != nil {
+		jsonError(w, "Failed to list games", http.StatusInternalServerError)
 		return
 	}
 
-	games.mu.Lock()
-	room := games.rooms[req.RoomID]
-	if room == nil {
-		games.mu.Unlock()
-		jsonError(w, "Game not found", http.StatusNotFound)
+	jsonResponse(w, map[string]interface{}{"games": json.RawMessage(encoded), "count": len(list)})
+}
+
+// handleAdminDeleteGame force-removes a room, such as one stuck mid-game.
+// No result is recorded.
+func handleAdminDeleteGame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	// Verify user is in this game
-	isInGame := (room.PlayerX != nil && room.PlayerX.ID == user.ID) ||
-		(room.PlayerO != nil && room.PlayerO.ID == user.ID)
-	if !isInGame {
-		games.mu.Unlock()
-		jsonError(w, "You are not in this game", http.StatusForbidden)
+	if !requireAdmin(w, r) {
 		return
 	}
 
-	// Set the emote
-	room.ShowEmote = true
-	room.EmoteType = req.EmoteType
-	room.EmoteBy = user.Username
-	room.EmoteAt = time.Now()
-	room.UpdatedAt = time.Now()
+	id := r.PathValue("id")
 
+	games.mu.Lock()
+	room := games.rooms[id]
+	if room != nil {
+		delete(games.codes, room.Code)
+		delete(games.rooms, room.ID)
+	}
 	games.mu.Unlock()
 
-	log.Printf("Game %s: %s triggered emote %s", room.Code, user.Username, req.EmoteType)
+	if room == nil {
+		jsonError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	logf(r, "Game %s: removed by admin (status %s)", room.Code, room.Status)
 
-	jsonResponse(w, room)
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// newJSONEncoder returns an encoder for a response body, indented when
+// -pretty is set
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if prettyJSON {
+		enc.SetIndent("", "  ")
+	}
+	return enc
 }
 
 // jsonResponse sends a JSON response
 func jsonResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	newJSONEncoder(w).Encode(data)
 }
 
 // jsonError sends a JSON error response
 func jsonError(w http.ResponseWriter, message string, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	newJSONEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// jsonFieldError sends a JSON error response naming the request field
+// that was rejected, in the same shape as decodeRequest's validation errors
+func jsonFieldError(w http.ResponseWriter, code, field, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	newJSONEncoder(w).Encode(map[string]string{"error": message, "code": code, "field": field})
+}
+
+// jsonErrorCode sends a JSON error response with a machine-readable code
+func jsonErrorCode(w http.ResponseWriter, code, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	newJSONEncoder(w).Encode(map[string]string{"error": message, "code": code})
 }
@@ -0,0 +1,3923 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The server and the CLI are both package main, so run these with
+//
+//	go test server.go server_test.go
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// setupServer gives a test fresh global state: no users, sessions, or
+// rooms, and a FileStore in a temporary directory
+func setupServer(t *testing.T) {
+	t.Helper()
+
+	db = &Database{Users: make(map[string]*User)}
+	sessions = &SessionStore{
+		sessions: make(map[string]*list.Element),
+		lru:      list.New(),
+		max:      maxSessions,
+
+		OnEnd: forgetGuest,
+	}
+	games = &GameStore{
+		rooms: make(map[string]*GameRoom),
+		codes: make(map[string]string),
+
+		created: make(map[idempotencyKey]createdRoom),
+	}
+	dataDir = t.TempDir()
+	store = &FileStore{path: filepath.Join(dataDir, "users.json")}
+	limiter = &ipLimiter{limit: rateLimit, window: time.Minute, clients: make(map[string]*ipWindow)}
+	hintLimiter = &ipLimiter{limit: hintLimit, window: time.Minute, clients: make(map[string]*ipWindow)}
+}
+
+// setVar sets a configuration variable for the rest of a test
+func setVar[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+// call sends a request straight to handler. A string body is sent as is,
+// anything else as JSON; token, if set, is sent as a bearer token.
+func call(t *testing.T, handler http.HandlerFunc, method, target, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader
+	if s, ok := body.(string); ok {
+		reader = strings.NewReader(s)
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, target, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// decode unmarshals a response body into v
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+}
+
+// expectStatus fails the test if rec does not have the given status
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+// errorCode returns the code of a JSON error response
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	decode(t, rec, &body)
+	return body.Code
+}
+
+// register creates a user and returns their session token
+func register(t *testing.T, username string) string {
+	t.Helper()
+	rec := call(t, handleRegister, "POST", "/api/register", "", map[string]string{"username": username})
+	expectStatus(t, rec, http.StatusOK)
+
+	var resp struct {
+		Token string `json:"token"`
+	}
+	decode(t, rec, &resp)
+	return resp.Token
+}
+
+// createGame creates a room with the given options and returns it
+func createGame(t *testing.T, token string, options map[string]interface{}) *GameRoom {
+	t.Helper()
+	if options == nil {
+		options = map[string]interface{}{}
+	}
+	rec := call(t, handleCreateGame, "POST", "/api/game/create", token, options)
+	expectStatus(t, rec, http.StatusOK)
+
+	var room GameRoom
+	decode(t, rec, &room)
+	return games.rooms[room.ID]
+}
+
+// joinGame joins the room with the given code
+func joinGame(t *testing.T, token, code string) {
+	t.Helper()
+	rec := call(t, handleJoinGame, "POST", "/api/game/join", token, map[string]string{"code": code})
+	expectStatus(t, rec, http.StatusOK)
+}
+
+// startGameFor creates a room for two new players and starts it,
+// returning the room and the tokens of X and O
+func startGameFor(t *testing.T, options map[string]interface{}) (*GameRoom, string, string) {
+	t.Helper()
+	tokenX := register(t, "alice")
+	tokenO := register(t, "bob")
+	room := createGame(t, tokenX, options)
+	joinGame(t, tokenO, room.Code)
+	return room, tokenX, tokenO
+}
+
+// move plays index in room as the holder of token
+func move(t *testing.T, room *GameRoom, token string, index int) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleGameMove, "POST", "/api/game/move", token, map[string]interface{}{"room_id": room.ID, "index": index})
+}
+
+func TestCreateGameWinLength(t *testing.T) {
+	tests := []struct {
+		name      string
+		boardSize int
+		winLength int
+		code      string // expected error code, "" for success
+	}{
+		{"3x3 needs 3", 3, 3, ""},
+		{"default for 3x3", 3, 0, ""},
+		{"longer than board", 3, 5, "win_length_too_long"},
+		{"one longer than board", 4, 5, "win_length_too_long"},
+		{"too short", 5, 2, "win_length_too_short"},
+		{"negative", 3, -1, "win_length_too_short"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupServer(t)
+			token := register(t, "alice")
+
+			rec := call(t, handleCreateGame, "POST", "/api/game/create", token,
+				map[string]int{"board_size": tt.boardSize, "win_length": tt.winLength})
+			if tt.code == "" {
+				expectStatus(t, rec, http.StatusOK)
+				var room GameRoom
+				decode(t, rec, &room)
+				if room.BoardSize != tt.boardSize || room.WinLength != 3 {
+					t.Errorf("got %dx%d needing %d, want %dx%d needing 3", room.BoardSize, room.BoardSize, room.WinLength, tt.boardSize, tt.boardSize)
+				}
+				return
+			}
+
+			expectStatus(t, rec, http.StatusBadRequest)
+			if code := errorCode(t, rec); code != tt.code {
+				t.Errorf("code = %q, want %q", code, tt.code)
+			}
+		})
+	}
+}
+
+// newPlayingRoom returns a room on a size x size board with play under
+// way between x and o, X to move. It isn't added to the store.
+func newPlayingRoom(size int, x, o *User) *GameRoom {
+	now := time.Now().UTC()
+	return &GameRoom{
+		ID:            generateID(),
+		Code:          generateGameCode(),
+		BoardSize:     size,
+		WinLength:     defaultWinLength(size),
+		WinPattern:    "line",
+		Board:         make([]string, size*size),
+		PlayerX:       x,
+		PlayerO:       o,
+		CurrentTurn:   "X",
+		Status:        "playing",
+		LastMove:      -1,
+		Mode:          "standard",
+		TimeoutPolicy: "forfeit",
+		CreatedAt:     now,
+		StartedAt:     now,
+		TurnStartedAt: now,
+	}
+}
+
+// playMoves applies moves in turn order, failing the test on a rejection
+func playMoves(t *testing.T, room *GameRoom, moves ...int) {
+	t.Helper()
+	for _, index := range moves {
+		player := room.PlayerX
+		if room.CurrentTurn == "O" {
+			player = room.PlayerO
+		}
+		if err := applyMove(room, player.ID, index); err != nil {
+			t.Fatalf("move %d: %v", index, err)
+		}
+	}
+}
+
+func TestApplyMoveRejections(t *testing.T) {
+	x := &User{ID: "x", Username: "alice"}
+	o := &User{ID: "o", Username: "bob"}
+
+	tests := []struct {
+		name   string
+		setup  func(room *GameRoom)
+		userID string
+		index  int
+		want   *MoveError
+	}{
+		{"game not in progress", func(room *GameRoom) { room.Status = "cancelled" }, "x", 0, errGameNotInProgress},
+		{"not a player", nil, "carol", 0, errNotInGame},
+		{"not your turn", nil, "o", 0, errNotYourTurn},
+		{"negative index", nil, "x", -1, errInvalidPosition},
+		{"index past the board", nil, "x", 9, errInvalidPosition},
+		{"cell taken", func(room *GameRoom) {
+			room.Board[4] = "X"
+			room.Board[0] = "O"
+		}, "x", 4, errCellTaken},
+		{"missing O", func(room *GameRoom) { room.PlayerO = nil }, "x", 0, errMissingPlayer},
+		{"missing X", func(room *GameRoom) { room.PlayerX = nil }, "o", 0, errMissingPlayer},
+		{"same player in both seats", func(room *GameRoom) { room.PlayerO = room.PlayerX }, "x", 0, errSamePlayer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupServer(t)
+			room := newPlayingRoom(3, x, o)
+			if tt.setup != nil {
+				tt.setup(room)
+			}
+			before := append([]string(nil), room.Board...)
+
+			err := applyMove(room, tt.userID, tt.index)
+			if err != tt.want {
+				t.Fatalf("applyMove = %v, want %v", err, tt.want)
+			}
+			if strings.Join(room.Board, ",") != strings.Join(before, ",") {
+				t.Errorf("rejected move changed the board to %q", room.Board)
+			}
+		})
+	}
+}
+
+func TestApplyMove(t *testing.T) {
+	x := &User{ID: "x", Username: "alice"}
+	o := &User{ID: "o", Username: "bob"}
+
+	t.Run("switches turns", func(t *testing.T) {
+		setupServer(t)
+		room := newPlayingRoom(3, x, o)
+		if err := applyMove(room, "x", 4); err != nil {
+			t.Fatal(err)
+		}
+		if room.Board[4] != "X" || room.CurrentTurn != "O" || room.LastMove != 4 {
+			t.Errorf("board %q, turn %s, last move %d", room.Board, room.CurrentTurn, room.LastMove)
+		}
+	})
+
+	t.Run("detects a win", func(t *testing.T) {
+		setupServer(t)
+		room := newPlayingRoom(3, x, o)
+		playMoves(t, room, 0, 3, 1, 4, 2)
+		if room.Status != "finished" || room.Winner != "X" {
+			t.Fatalf("status %s, winner %q; want X to win", room.Status, room.Winner)
+		}
+		if got := room.WinningLine; len(got) != 3 || got[0] != 0 || got[1] != 1 || got[2] != 2 {
+			t.Errorf("winning line = %v, want [0 1 2]", got)
+		}
+	})
+
+	t.Run("detects a draw", func(t *testing.T) {
+		setupServer(t)
+		room := newPlayingRoom(3, x, o)
+		// X O X
+		// X O O
+		// O X X
+		playMoves(t, room, 0, 1, 2, 4, 3, 5, 7, 6, 8)
+		if room.Status != "finished" || room.Winner != "draw" {
+			t.Errorf("status %s, winner %q; want a draw", room.Status, room.Winner)
+		}
+	})
+}
+
+func TestMoveErrorStatus(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+
+	rec := move(t, room, tokenO, 0)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if code := errorCode(t, rec); code != "not_your_turn" {
+		t.Errorf("code = %q, want not_your_turn", code)
+	}
+
+	rec = move(t, room, register(t, "carol"), 0)
+	expectStatus(t, rec, http.StatusForbidden)
+	if code := errorCode(t, rec); code != "not_in_game" {
+		t.Errorf("code = %q, want not_in_game", code)
+	}
+
+	expectStatus(t, move(t, room, tokenX, 0), http.StatusOK)
+}
+
+// postForm sends a form-encoded POST straight to handler
+func postForm(t *testing.T, handler http.HandlerFunc, target, token string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestFormEncodedBodies(t *testing.T) {
+	setupServer(t)
+
+	rec := postForm(t, handleRegister, "/api/register", "", url.Values{"username": {"alice"}})
+	expectStatus(t, rec, http.StatusOK)
+	var resp struct {
+		Token string `json:"token"`
+		User  User   `json:"user"`
+	}
+	decode(t, rec, &resp)
+	if resp.User.Username != "alice" {
+		t.Fatalf("registered %q, want alice", resp.User.Username)
+	}
+
+	room := createGame(t, resp.Token, nil)
+	joinGame(t, register(t, "bob"), room.Code)
+
+	rec = postForm(t, handleGameMove, "/api/game/move", resp.Token, url.Values{"room_id": {room.ID}, "index": {"4"}})
+	expectStatus(t, rec, http.StatusOK)
+	if room.Board[4] != "X" {
+		t.Errorf("board = %q, want X at 4", room.Board)
+	}
+
+	rec = postForm(t, handleGameMove, "/api/game/move", resp.Token, url.Values{"room_id": {room.ID}, "index": {"four"}})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestBodyWithoutContentTypeIsJSON(t *testing.T) {
+	setupServer(t)
+
+	req := httptest.NewRequest("POST", "/api/register", strings.NewReader(`{"username":"alice"}`))
+	rec := httptest.NewRecorder()
+	handleRegister(rec, req)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestMaxGames(t *testing.T) {
+	setupServer(t)
+	setVar(t, &maxGames, 2)
+	token := register(t, "alice")
+
+	first := createGame(t, token, nil)
+	createGame(t, token, nil)
+
+	rec := call(t, handleCreateGame, "POST", "/api/game/create", token, map[string]int{})
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if code := errorCode(t, rec); code != "server_busy" {
+		t.Errorf("code = %q, want server_busy", code)
+	}
+
+	// Finished rooms don't count toward the cap
+	first.Status = "finished"
+	createGame(t, token, nil)
+
+	// Rooms removed by cleanup free their place
+	expectStatus(t, call(t, handleCreateGame, "POST", "/api/game/create", token, map[string]int{}), http.StatusServiceUnavailable)
+	sweepOldGames(time.Now().UTC().Add(gameTTL + time.Minute))
+	if n := len(games.rooms); n != 0 {
+		t.Fatalf("%d rooms left after cleanup, want 0", n)
+	}
+	createGame(t, token, nil)
+}
+
+// getState fetches the room's state as seen by the holder of token
+func getState(t *testing.T, room *GameRoom, token string) gameStateResponse {
+	t.Helper()
+	rec := call(t, handleGameState, "GET", "/api/game/state?room_id="+room.ID, token, nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	var state gameStateResponse
+	decode(t, rec, &state)
+	return state
+}
+
+func TestGameClockDecrements(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, map[string]interface{}{"total_seconds": 60})
+
+	room.TurnStartedAt = room.TurnStartedAt.Add(-5 * time.Second)
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+
+	state := getState(t, room, tokenX)
+	if state.TimeLeftX < 54 || state.TimeLeftX > 55.5 {
+		t.Errorf("X has %.1fs left after a 5s move, want about 55", state.TimeLeftX)
+	}
+	if state.TimeLeftO != 60 {
+		t.Errorf("O has %.1fs left before moving, want 60", state.TimeLeftO)
+	}
+}
+
+func TestGameClockForfeits(t *testing.T) {
+	t.Run("on a late move", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, _ := startGameFor(t, map[string]interface{}{"total_seconds": 60})
+
+		room.TurnStartedAt = room.TurnStartedAt.Add(-61 * time.Second)
+		rec := move(t, room, tokenX, 4)
+		expectStatus(t, rec, http.StatusBadRequest)
+		if code := errorCode(t, rec); code != "time_expired" {
+			t.Errorf("code = %q, want time_expired", code)
+		}
+		if room.Status != "finished" || room.Winner != "O" || room.ForfeitedBy != "X" {
+			t.Errorf("status %s, winner %q, forfeited by %q; want X to forfeit", room.Status, room.Winner, room.ForfeitedBy)
+		}
+		if room.TimeLeftX != 0 {
+			t.Errorf("X has %.1fs left, want 0", room.TimeLeftX)
+		}
+	})
+
+	t.Run("when polled", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, _ := startGameFor(t, map[string]interface{}{"total_seconds": 60})
+		expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+
+		room.TurnStartedAt = room.TurnStartedAt.Add(-61 * time.Second)
+		state := getState(t, room, tokenX)
+		if state.Status != "finished" || state.Winner != "X" || state.ForfeitedBy != "O" {
+			t.Errorf("status %s, winner %q, forfeited by %q; want O to forfeit", state.Status, state.Winner, state.ForfeitedBy)
+		}
+		if user := findUserByUsername("bob"); user.Scores.Losses != 1 {
+			t.Errorf("O has %d losses, want 1", user.Scores.Losses)
+		}
+	})
+}
+
+func TestLoginFailuresLookAlike(t *testing.T) {
+	setupServer(t)
+	register(t, "alice")
+
+	rec := call(t, handleGuest, "POST", "/api/guest", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var guest struct {
+		User User `json:"user"`
+	}
+	decode(t, rec, &guest)
+
+	unknown := call(t, handleLogin, "POST", "/api/login", "", map[string]string{"username": "nobody"})
+	guestLogin := call(t, handleLogin, "POST", "/api/login", "", map[string]string{"username": guest.User.Username})
+
+	expectStatus(t, unknown, http.StatusUnauthorized)
+	if unknown.Code != guestLogin.Code || unknown.Body.String() != guestLogin.Body.String() {
+		t.Errorf("unknown user got %d %s, guest got %d %s", unknown.Code, unknown.Body, guestLogin.Code, guestLogin.Body)
+	}
+
+	expectStatus(t, call(t, handleLogin, "POST", "/api/login", "", map[string]string{"username": "alice"}), http.StatusOK)
+}
+
+func TestCancelGame(t *testing.T) {
+	setupServer(t)
+	tokenX := register(t, "alice")
+	tokenO := register(t, "bob")
+	room := createGame(t, tokenX, nil)
+
+	rec := call(t, handleCancelGame, "POST", "/api/game/cancel", tokenO, map[string]string{"code": room.Code})
+	expectStatus(t, rec, http.StatusForbidden)
+
+	rec = call(t, handleCancelGame, "POST", "/api/game/cancel", tokenX, map[string]string{"code": strings.ToLower(room.Code)})
+	expectStatus(t, rec, http.StatusOK)
+	if _, ok := games.rooms[room.ID]; ok {
+		t.Error("cancelled room is still stored")
+	}
+	if _, ok := games.codes[room.Code]; ok {
+		t.Error("cancelled room's code is still taken")
+	}
+
+	rec = call(t, handleJoinGame, "POST", "/api/game/join", tokenO, map[string]string{"code": room.Code})
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestCancelStartedGame(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+
+	rec := call(t, handleCancelGame, "POST", "/api/game/cancel", tokenX, map[string]string{"code": room.Code})
+	expectStatus(t, rec, http.StatusConflict)
+	if games.rooms[room.ID] == nil {
+		t.Error("started room was removed")
+	}
+}
+
+func TestValidateStruct(t *testing.T) {
+	type request struct {
+		Name  string `json:"name" validate:"required,min=2,max=4"`
+		Count int    `json:"count" validate:"min=0,max=9"`
+		Kind  string `json:"kind" validate:"omitempty,oneof=a b"`
+		Index *int   `json:"index" validate:"required"`
+	}
+	zero := 0
+
+	tests := []struct {
+		name  string
+		req   request
+		field string // "" if valid
+		msg   string
+	}{
+		{"valid", request{Name: "ab", Kind: "a", Index: &zero}, "", ""},
+		{"omitempty skips zero", request{Name: "ab", Index: &zero}, "", ""},
+		{"required string", request{Index: &zero}, "name", "name is required"},
+		{"short string", request{Name: "a", Index: &zero}, "name", "name must be at least 2 characters"},
+		{"long string", request{Name: "abcde", Index: &zero}, "name", "name must be at most 4 characters"},
+		{"long in runes", request{Name: "éééé", Index: &zero}, "", ""},
+		{"small int", request{Name: "ab", Count: -1, Index: &zero}, "count", "count must be at least 0"},
+		{"large int", request{Name: "ab", Count: 10, Index: &zero}, "count", "count must be at most 9"},
+		{"not one of", request{Name: "ab", Kind: "c", Index: &zero}, "kind", "kind must be one of: a, b"},
+		{"required pointer", request{Name: "ab"}, "index", "index is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStruct(&tt.req)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("validateStruct = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("validateStruct = nil, want an error for %s", tt.field)
+			}
+			if err.Field != tt.field || err.Error() != tt.msg {
+				t.Errorf("validateStruct = %q on %s, want %q on %s", err, err.Field, tt.msg, tt.field)
+			}
+		})
+	}
+}
+
+func TestDecodeRequestFieldError(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	rec := call(t, handleCreateGame, "POST", "/api/game/create", token, map[string]interface{}{"timeout_policy": "never"})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	var body map[string]string
+	decode(t, rec, &body)
+	if body["code"] != "invalid_field" || body["field"] != "timeout_policy" {
+		t.Errorf("got %v, want an invalid_field error for timeout_policy", body)
+	}
+}
+
+func TestYourTurn(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+
+	check := func(token, wantSymbol string, wantTurn bool) {
+		t.Helper()
+		state := getState(t, room, token)
+		if state.YourSymbol != wantSymbol || state.YourTurn != wantTurn {
+			t.Errorf("your_symbol %q, your_turn %v; want %q, %v", state.YourSymbol, state.YourTurn, wantSymbol, wantTurn)
+		}
+	}
+
+	check(tokenX, "X", true)
+	check(tokenO, "O", false)
+	check("", "", false)
+
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+	check(tokenX, "X", false)
+	check(tokenO, "O", true)
+}
+
+// leave leaves room as the holder of token
+func leave(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleLeaveGame, "POST", "/api/game/leave", token, map[string]string{"room_id": room.ID})
+}
+
+func TestLeaveWithMissingOpponent(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+	room.PlayerO = nil
+
+	rec := leave(t, room, tokenX)
+	expectStatus(t, rec, http.StatusConflict)
+	if code := errorCode(t, rec); code != "opponent_missing" {
+		t.Errorf("error code %q, want opponent_missing", code)
+	}
+	if games.rooms[room.ID] != nil {
+		t.Error("room without an opponent was kept")
+	}
+	if user := findUserByUsername("alice"); user.Scores != (Scores{}) {
+		t.Errorf("leaving player was scored: %+v", user.Scores)
+	}
+}
+
+func TestRecordResultWithMissingPlayer(t *testing.T) {
+	setupServer(t)
+	o := &User{ID: "o", Username: "bob"}
+
+	for _, winner := range []string{"X", "O", "draw"} {
+		room := newPlayingRoom(3, nil, o)
+		room.Winner = winner
+		room.Status = "finished"
+		recordResult(room)
+	}
+	if o.Scores != (Scores{Wins: 1, Draws: 1}) {
+		t.Errorf("O's scores = %+v, want one win and one draw", o.Scores)
+	}
+}
+
+func TestLastMoveBy(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+
+	state := getState(t, room, tokenX)
+	if state.LastMove != -1 || state.LastMoveBy != "" {
+		t.Errorf("new game has last move %d by %q, want -1 by nobody", state.LastMove, state.LastMoveBy)
+	}
+
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+	expectStatus(t, move(t, room, tokenO, 0), http.StatusOK)
+	state = getState(t, room, tokenX)
+	if state.LastMove != 0 || state.LastMoveBy != "O" {
+		t.Errorf("last move %d by %q, want 0 by O", state.LastMove, state.LastMoveBy)
+	}
+
+	// The next game starts from a fresh room
+	next := createGame(t, tokenX, nil)
+	if next.LastMove != -1 || next.LastMoveBy != "" {
+		t.Errorf("next game has last move %d by %q, want -1 by nobody", next.LastMove, next.LastMoveBy)
+	}
+}
+
+func TestUsernameBlocklist(t *testing.T) {
+	setupServer(t)
+	setVar(t, &blockedWords, nil)
+
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("# rude words\nBadWord\n\n  meanie  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadBlocklist(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(blockedWords) != 2 {
+		t.Fatalf("loaded %q, want two words", blockedWords)
+	}
+
+	for _, name := range []string{"badword", "xxBADWORDxx", "Meanie42"} {
+		rec := call(t, handleRegister, "POST", "/api/register", "", map[string]string{"username": name})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+	register(t, "goodname")
+}
+
+func TestTimestampsAreUTC(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	rec := call(t, handleCreateGame, "POST", "/api/game/create", token, map[string]int{})
+	expectStatus(t, rec, http.StatusOK)
+	var room map[string]interface{}
+	decode(t, rec, &room)
+
+	for _, key := range []string{"created_at", "updated_at"} {
+		if s, _ := room[key].(string); !strings.HasSuffix(s, "Z") {
+			t.Errorf("%s = %q, want a UTC timestamp", key, s)
+		}
+	}
+
+	rec = call(t, handleGetUser, "GET", "/api/user", token, nil)
+	var user map[string]interface{}
+	decode(t, rec, &user)
+	if s, _ := user["created_at"].(string); !strings.HasSuffix(s, "Z") {
+		t.Errorf("user created_at = %q, want a UTC timestamp", s)
+	}
+}
+
+// cells builds a board from a string of cells, "." for empty
+func cells(s string) []string {
+	board := make([]string, len(s))
+	for i, c := range s {
+		if c != '.' {
+			board[i] = string(c)
+		}
+	}
+	return board
+}
+
+func TestCanonicalKey(t *testing.T) {
+	// Every rotation and reflection of one position
+	same := []string{
+		"XO.......",
+		"X..O.....",
+		".OX......",
+		"..X..O...",
+		"......XO.",
+		"...O..X..",
+		".......OX",
+		".....O..X",
+	}
+	want := canonicalKey(cells(same[0]), 3)
+	for _, board := range same[1:] {
+		if got := canonicalKey(cells(board), 3); got != want {
+			t.Errorf("canonicalKey(%s) = %s, want %s", board, got, want)
+		}
+	}
+
+	for _, board := range []string{"X.O......", "O.X......", "XO..X...."} {
+		if got := canonicalKey(cells(board), 3); got == want {
+			t.Errorf("canonicalKey(%s) = %s, same as a different position", board, got)
+		}
+	}
+
+	// A 4x4 board turned a quarter
+	a := cells("XX..............")
+	b := cells("...X...X........")
+	if canonicalKey(a, 4) != canonicalKey(b, 4) {
+		t.Errorf("rotated 4x4 boards have keys %s and %s", canonicalKey(a, 4), canonicalKey(b, 4))
+	}
+}
+
+func TestExportGameCanonical(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+	expectStatus(t, move(t, room, tokenX, 8), http.StatusOK)
+
+	rec := call(t, handleExportGame, "GET", "/api/game/export?room_id="+room.ID, "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var export struct {
+		Canonical string `json:"canonical"`
+	}
+	decode(t, rec, &export)
+	if export.Canonical != "--------X" {
+		t.Errorf("canonical = %q, want --------X", export.Canonical)
+	}
+}
+
+// savedUser reads username's record back from the store's file
+func savedUser(t *testing.T, username string) *User {
+	t.Helper()
+	users, err := (&FileStore{path: filepath.Join(dataDir, "users.json")}).LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range users {
+		if user.Username == username {
+			return user
+		}
+	}
+	t.Fatalf("%s was not saved", username)
+	return nil
+}
+
+func TestResetScores(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+	playMoves(t, room, 0, 3, 1, 4, 2)
+	recordResult(room)
+	persistResult(room)
+	if savedUser(t, "alice").Scores.Wins != 1 {
+		t.Fatal("win was not saved")
+	}
+
+	rec := call(t, handleResetScores, "POST", "/api/user/reset-scores", tokenX, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var user User
+	decode(t, rec, &user)
+	if user.Scores != (Scores{}) || user.SizeScores != nil {
+		t.Errorf("scores after reset = %+v, %v", user.Scores, user.SizeScores)
+	}
+	if saved := savedUser(t, "alice"); saved.Scores != (Scores{}) || saved.SizeScores != nil {
+		t.Errorf("saved scores after reset = %+v, %v", saved.Scores, saved.SizeScores)
+	}
+
+	// Only the caller's scores are reset
+	if saved := savedUser(t, "bob"); saved.Scores.Losses != 1 {
+		t.Errorf("opponent's saved scores = %+v, want their loss kept", saved.Scores)
+	}
+}
+
+func TestGenerateWinningConditions(t *testing.T) {
+	tests := []struct {
+		size, winLen int
+		lines        int // rows, columns, and diagonals together
+		diagonals    int
+	}{
+		{3, 3, 8, 2},
+		{4, 3, 24, 8},
+		{4, 4, 10, 2},
+		{5, 4, 28, 8},
+		{6, 4, 54, 18},
+		{6, 6, 14, 2},
+	}
+
+	for _, tt := range tests {
+		conditions := generateWinningConditions(tt.size, tt.winLen)
+		diagonals := 0
+		for _, condition := range conditions {
+			r0, c0 := indexToRowCol(condition[0], tt.size)
+			r1, c1 := indexToRowCol(condition[1], tt.size)
+			if r1-r0 == 1 && (c1-c0 == 1 || c1-c0 == -1) {
+				diagonals++
+			}
+		}
+		if len(conditions) != tt.lines || diagonals != tt.diagonals {
+			t.Errorf("size %d, win %d: %d lines with %d diagonals, want %d with %d",
+				tt.size, tt.winLen, len(conditions), diagonals, tt.lines, tt.diagonals)
+		}
+	}
+}
+
+func TestWinningConditionsStayOnBoard(t *testing.T) {
+	for size := 3; size <= 9; size++ {
+		for winLen := 3; winLen <= size; winLen++ {
+			for _, condition := range generateWinningConditions(size, winLen) {
+				if len(condition) != winLen {
+					t.Fatalf("size %d, win %d: line %v has the wrong length", size, winLen, condition)
+				}
+				for _, idx := range condition {
+					if idx < 0 || idx >= size*size {
+						t.Fatalf("size %d, win %d: line %v leaves the board", size, winLen, condition)
+					}
+				}
+
+				// Each step moves to the next cell right, down, or
+				// diagonally down, without wrapping around an edge
+				r, c := indexToRowCol(condition[0], size)
+				nr, nc := indexToRowCol(condition[1], size)
+				dr, dc := nr-r, nc-c
+				if dr < 0 || dr > 1 || dc < -1 || dc > 1 || (dr == 0 && dc != 1) {
+					t.Fatalf("size %d, win %d: line %v doesn't step to a neighbour", size, winLen, condition)
+				}
+				for _, idx := range condition[1:] {
+					r, c = r+dr, c+dc
+					if idx != rowColToIndex(r, c, size) || c < 0 || c >= size {
+						t.Fatalf("size %d, win %d: line %v wraps or bends", size, winLen, condition)
+					}
+				}
+			}
+		}
+	}
+
+	if conditions := generateWinningConditions(3, 5); conditions != nil {
+		t.Errorf("a 5-long line on a 3x3 board gave %d conditions, want none", len(conditions))
+	}
+}
+
+func TestSweepAbandonsGameInProgress(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+
+	idle := time.Now().UTC().Add(gameTTL + time.Minute)
+	sweepOldGames(idle)
+
+	// The room stays so players polling it learn why the game ended
+	state := getState(t, room, tokenX)
+	if state.Status != "abandoned" || state.Winner != "" {
+		t.Fatalf("status %s, winner %q; want abandoned with no result", state.Status, state.Winner)
+	}
+	if state.Board[4] != "X" {
+		t.Errorf("abandoned board = %q, want the last position kept", state.Board)
+	}
+	if n := activeRoomCount(); n != 0 {
+		t.Errorf("%d active rooms, want the abandoned one not counted", n)
+	}
+	if user := findUserByUsername("alice"); user.Scores != (Scores{}) {
+		t.Errorf("abandoned game was scored: %+v", user.Scores)
+	}
+
+	sweepOldGames(idle.Add(finishedRetention + time.Second))
+	if games.rooms[room.ID] != nil {
+		t.Error("abandoned room was never removed")
+	}
+}
+
+func TestRowColRoundTrip(t *testing.T) {
+	for size := 3; size <= 7; size++ {
+		for index := 0; index < size*size; index++ {
+			row, col := indexToRowCol(index, size)
+			if row < 0 || row >= size || col < 0 || col >= size {
+				t.Fatalf("indexToRowCol(%d, %d) = %d, %d, off the board", index, size, row, col)
+			}
+			if got := rowColToIndex(row, col, size); got != index {
+				t.Fatalf("size %d: index %d -> (%d, %d) -> %d", size, index, row, col, got)
+			}
+		}
+	}
+}
+
+func TestMoveByRowCol(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, map[string]interface{}{"board_size": 4})
+
+	rec := call(t, handleGameMove, "POST", "/api/game/move", tokenX, map[string]interface{}{"room_id": room.ID, "row": 2, "col": 1})
+	expectStatus(t, rec, http.StatusOK)
+	if room.Board[9] != "X" {
+		t.Errorf("board = %q, want X at index 9", room.Board)
+	}
+
+	for _, rc := range [][2]int{{4, 0}, {0, 4}, {-1, 0}} {
+		rec := call(t, handleGameMove, "POST", "/api/game/move", tokenX, map[string]interface{}{"room_id": room.ID, "row": rc[0], "col": rc[1]})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+
+	rec = call(t, handleGameMove, "POST", "/api/game/move", tokenX, map[string]interface{}{"room_id": room.ID, "row": 1})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+// playTurns plays moves through the move endpoint, alternating between
+// the two tokens starting with X
+func playTurns(t *testing.T, room *GameRoom, tokenX, tokenO string, moves ...int) {
+	t.Helper()
+	for i, index := range moves {
+		token := tokenX
+		if i%2 == 1 {
+			token = tokenO
+		}
+		expectStatus(t, move(t, room, token, index), http.StatusOK)
+	}
+}
+
+// leaderboard fetches the leaderboard with the given query string
+func leaderboard(t *testing.T, query string) []User {
+	t.Helper()
+	rec := call(t, handleLeaderboard, "GET", "/api/leaderboard?"+query, "", nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	var users []User
+	decode(t, rec, &users)
+	return users
+}
+
+func TestLeaderboardBySize(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"board_size": 5})
+	playTurns(t, room, tokenX, tokenO, 0, 5, 1, 6, 2, 7, 3)
+	if room.Winner != "X" {
+		t.Fatalf("winner = %q, want X", room.Winner)
+	}
+
+	wins := func(users []User, username string) int {
+		for _, user := range users {
+			if user.Username == username {
+				return user.Scores.Wins
+			}
+		}
+		return -1
+	}
+
+	if got := wins(leaderboard(t, "board_size=5"), "alice"); got != 1 {
+		t.Errorf("5x5 leaderboard has alice with %d wins, want 1", got)
+	}
+	if got := wins(leaderboard(t, "board_size=3"), "alice"); got != -1 {
+		t.Errorf("3x3 leaderboard has alice with %d wins, want her absent", got)
+	}
+	if got := wins(leaderboard(t, ""), "alice"); got != 1 {
+		t.Errorf("overall leaderboard has alice with %d wins, want 1", got)
+	}
+
+	rec := call(t, handleLeaderboard, "GET", "/api/leaderboard?board_size=big", "", nil)
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r)
+	}))
+
+	serve := func(id string) string {
+		req := httptest.NewRequest("GET", "/api/version", nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		echoed := rec.Header().Get("X-Request-ID")
+		if echoed != seen {
+			t.Errorf("echoed %q but the handler saw %q", echoed, seen)
+		}
+		return echoed
+	}
+
+	if got := serve("client-id-1"); got != "client-id-1" {
+		t.Errorf("X-Request-ID = %q, want the client's", got)
+	}
+
+	generated := serve("")
+	if len(generated) != 32 {
+		t.Errorf("generated X-Request-ID = %q, want a 32-character ID", generated)
+	}
+	if again := serve(""); again == generated {
+		t.Error("two requests were given the same ID")
+	}
+
+	// IDs that could forge log lines are replaced
+	if got := serve("bad id\nINFO fake"); got == "bad id\nINFO fake" || len(got) != 32 {
+		t.Errorf("X-Request-ID = %q, want a generated ID", got)
+	}
+}
+
+// sendEmote triggers an emote in room as the holder of token
+func sendEmote(t *testing.T, room *GameRoom, token, emoteType string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleGameEmote, "POST", "/api/game/emote", token, map[string]string{"room_id": room.ID, "emote_type": emoteType})
+}
+
+func TestListEmotesMatchesAllowlist(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+
+	rec := call(t, handleListEmotes, "GET", "/api/emotes", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var listed []Emote
+	decode(t, rec, &listed)
+	if len(listed) != len(emotes) {
+		t.Fatalf("listed %d emotes, want %d", len(listed), len(emotes))
+	}
+
+	for _, emote := range listed {
+		if emote.Type == "" || emote.Label == "" {
+			t.Errorf("emote %+v is missing its type or label", emote)
+		}
+		expectStatus(t, sendEmote(t, room, tokenX, emote.Type), http.StatusOK)
+	}
+
+	expectStatus(t, sendEmote(t, room, tokenX, "not_an_emote"), http.StatusBadRequest)
+}
+
+func TestGzipLeaderboard(t *testing.T) {
+	setupServer(t)
+	handler := gzipMiddleware(handleLeaderboard)
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/leaderboard", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		expectStatus(t, rec, http.StatusOK)
+		return rec
+	}
+
+	// Small bodies aren't worth compressing
+	if rec := get(); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("empty leaderboard was sent with Content-Encoding %q", rec.Header().Get("Content-Encoding"))
+	}
+
+	for i := 0; i < 10; i++ {
+		register(t, fmt.Sprintf("player-number-%02d", i))
+	}
+	rec := get()
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("leaderboard of %d bytes was not compressed", rec.Body.Len())
+	}
+	if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+		t.Error("compressed response is missing Vary: Accept-Encoding")
+	}
+
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []User
+	if err := json.NewDecoder(zr).Decode(&users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 10 {
+		t.Errorf("decompressed leaderboard has %d users, want 10", len(users))
+	}
+}
+
+func TestParseAuthToken(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		err    error
+	}{
+		{"", "", nil},
+		{"abc123", "abc123", nil},
+		{"Bearer abc123", "abc123", nil},
+		{"bearer abc123", "abc123", nil},
+		{"  Bearer   abc123  ", "abc123", nil},
+		{"Bearer", "", errMalformedAuth},
+		{"Basic abc123", "", errMalformedAuth},
+		{"Bearer abc 123", "", errMalformedAuth},
+	}
+
+	for _, tt := range tests {
+		token, err := parseAuthToken(tt.header)
+		if token != tt.token || err != tt.err {
+			t.Errorf("parseAuthToken(%q) = %q, %v; want %q, %v", tt.header, token, err, tt.token, tt.err)
+		}
+	}
+}
+
+func TestAuthorizationHeaderForms(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{token, http.StatusOK},
+		{"Bearer " + token, http.StatusOK},
+		{"Token " + token, http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/user", nil)
+		req.Header.Set("Authorization", tt.header)
+		rec := httptest.NewRecorder()
+		handleGetUser(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, rec.Code, tt.status)
+		}
+	}
+
+	// A malformed header is explained rather than treated as a bad token
+	req := httptest.NewRequest("GET", "/api/user", nil)
+	req.Header.Set("Authorization", "Token "+token)
+	rec := httptest.NewRecorder()
+	handleGetUser(rec, req)
+	if !strings.Contains(rec.Body.String(), "Malformed Authorization header") {
+		t.Errorf("malformed header response = %s", rec.Body)
+	}
+}
+
+func TestCurrentGame(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	idle := register(t, "carol")
+
+	for _, token := range []string{tokenX, tokenO} {
+		rec := call(t, handleCurrentGame, "GET", "/api/game/current", token, nil)
+		expectStatus(t, rec, http.StatusOK)
+		var state gameStateResponse
+		decode(t, rec, &state)
+		if state.ID != room.ID {
+			t.Errorf("current game = %s, want %s", state.ID, room.ID)
+		}
+	}
+
+	expectStatus(t, call(t, handleCurrentGame, "GET", "/api/game/current", idle, nil), http.StatusNotFound)
+
+	// A finished game is no longer current
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+	expectStatus(t, call(t, handleCurrentGame, "GET", "/api/game/current", tokenX, nil), http.StatusNotFound)
+}
+
+// failWrites makes every FileStore write fail for the rest of a test
+func failWrites(t *testing.T) {
+	t.Helper()
+	setVar(t, &writeFile, func(string, []byte, os.FileMode) error {
+		return errors.New("no space left on device")
+	})
+}
+
+func TestUpdateScoreSaveFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		body    interface{}
+	}{
+		{"score", handleUpdateScore, "/api/score", map[string]string{"result": "win"}},
+		{"reset scores", handleResetScores, "/api/user/reset-scores", nil},
+		{"preferences", handlePreferences, "/api/user/preferences", map[string]interface{}{"preferences": map[string]string{"theme": "dark"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupServer(t)
+			token := register(t, "alice")
+			failWrites(t)
+
+			rec := call(t, tt.handler, "POST", tt.target, token, tt.body)
+			expectStatus(t, rec, http.StatusInternalServerError)
+		})
+	}
+}
+
+func TestMoveReportsPersisted(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		t.Run(fmt.Sprintf("failing=%v", fail), func(t *testing.T) {
+			setupServer(t)
+			room, tokenX, tokenO := startGameFor(t, nil)
+			playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4)
+			if fail {
+				failWrites(t)
+			}
+
+			rec := move(t, room, tokenX, 2)
+			expectStatus(t, rec, http.StatusOK)
+			var state gameStateResponse
+			decode(t, rec, &state)
+			if state.Persisted == nil || *state.Persisted == fail {
+				t.Errorf("persisted = %v, want %v", state.Persisted, !fail)
+			}
+		})
+	}
+}
+
+func TestMoveWarnings(t *testing.T) {
+	t.Run("draw inevitable", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, tokenO := startGameFor(t, nil)
+		playTurns(t, room, tokenX, tokenO, 0, 1, 2, 3, 4, 6, 7)
+
+		// X O X
+		// O X .
+		// O X O
+		rec := move(t, room, tokenO, 8)
+		expectStatus(t, rec, http.StatusOK)
+		var state gameStateResponse
+		decode(t, rec, &state)
+		if state.Status != "playing" {
+			t.Fatalf("status = %s, want the game still in play", state.Status)
+		}
+		if len(state.Warnings) != 1 || state.Warnings[0] != warnDrawInevitable {
+			t.Errorf("warnings = %q, want [%s]", state.Warnings, warnDrawInevitable)
+		}
+	})
+
+	t.Run("low time", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, _ := startGameFor(t, map[string]interface{}{"total_seconds": 60})
+		room.TurnStartedAt = room.TurnStartedAt.Add(-55 * time.Second)
+
+		rec := move(t, room, tokenX, 4)
+		expectStatus(t, rec, http.StatusOK)
+		var state gameStateResponse
+		decode(t, rec, &state)
+		if len(state.Warnings) != 1 || state.Warnings[0] != warnLowTime {
+			t.Errorf("warnings = %q, want [%s]", state.Warnings, warnLowTime)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, _ := startGameFor(t, nil)
+
+		rec := move(t, room, tokenX, 4)
+		expectStatus(t, rec, http.StatusOK)
+		var state gameStateResponse
+		decode(t, rec, &state)
+		if state.Warnings != nil {
+			t.Errorf("warnings = %q, want none", state.Warnings)
+		}
+	})
+}
+
+func TestDefaultWinLength(t *testing.T) {
+	want := map[int]int{2: 0, 3: 3, 4: 3, 5: 4, 6: 4, 7: 4, 8: 0}
+	for size, winLen := range want {
+		if got := defaultWinLength(size); got != winLen {
+			t.Errorf("defaultWinLength(%d) = %d, want %d", size, got, winLen)
+		}
+		if winLen == 0 {
+			continue
+		}
+		if got, want := len(generateWinningConditions(size, 0)), len(generateWinningConditions(size, winLen)); got != want {
+			t.Errorf("size %d: default conditions have %d lines, want %d", size, got, want)
+		}
+	}
+}
+
+func TestCreateGameDefaultWinLength(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	for size := 3; size <= 7; size++ {
+		room := createGame(t, token, map[string]interface{}{"board_size": size})
+		if room.BoardSize != size || room.WinLength != defaultWinLength(size) {
+			t.Errorf("board size %d: got %dx%d needing %d", size, room.BoardSize, room.BoardSize, room.WinLength)
+		}
+	}
+
+	// Unsupported sizes fall back to 3x3
+	room := createGame(t, token, map[string]interface{}{"board_size": 9})
+	if room.BoardSize != 3 || room.WinLength != 3 {
+		t.Errorf("board size 9: got %dx%d needing %d, want the 3x3 default", room.BoardSize, room.BoardSize, room.WinLength)
+	}
+}
+
+func TestCheckGame(t *testing.T) {
+	setupServer(t)
+	full, tokenX, _ := startGameFor(t, nil)
+	waiting := createGame(t, tokenX, map[string]interface{}{"board_size": 4})
+
+	check := func(code string, status int) map[string]interface{} {
+		t.Helper()
+		rec := call(t, handleCheckGame, "GET", "/api/game/check?code="+url.QueryEscape(code), "", nil)
+		expectStatus(t, rec, status)
+		var body map[string]interface{}
+		decode(t, rec, &body)
+		return body
+	}
+
+	body := check(" "+strings.ToLower(waiting.Code)+" ", http.StatusOK)
+	if body["joinable"] != true || body["status"] != "waiting" || body["host"] != "alice" || body["board_size"] != 4.0 {
+		t.Errorf("waiting room check = %v", body)
+	}
+	if waiting.PlayerO != nil {
+		t.Error("checking a code joined the room")
+	}
+
+	body = check(full.Code, http.StatusOK)
+	if body["joinable"] != false || body["status"] != "playing" {
+		t.Errorf("full room check = %v", body)
+	}
+
+	body = check("NOPE42", http.StatusNotFound)
+	if body["code"] != "not_found" {
+		t.Errorf("unknown code check = %v", body)
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	l := &ipLimiter{limit: 3, window: time.Minute, clients: make(map[string]*ipWindow)}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("1.2.3.4", start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("request %d was refused under the limit", i+1)
+		}
+	}
+	if l.allow("1.2.3.4", start.Add(10*time.Second)) {
+		t.Error("request over the limit was allowed")
+	}
+	if !l.allow("5.6.7.8", start.Add(10*time.Second)) {
+		t.Error("another client was refused")
+	}
+
+	// The previous window still counts in full at its end, then fades
+	if l.allow("1.2.3.4", start.Add(time.Minute)) {
+		t.Error("request right after the window was allowed")
+	}
+	if !l.allow("1.2.3.4", start.Add(90*time.Second)) {
+		t.Error("request half a window later was refused")
+	}
+	if !l.allow("1.2.3.4", start.Add(5*time.Minute)) {
+		t.Error("request after an idle spell was refused")
+	}
+
+	unlimited := &ipLimiter{limit: 0, window: time.Minute, clients: make(map[string]*ipWindow)}
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow("1.2.3.4", start) {
+			t.Fatal("limit 0 refused a request")
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	setupServer(t)
+	limiter = &ipLimiter{limit: 2, window: time.Minute, clients: make(map[string]*ipWindow)}
+	handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	get("/api/leaderboard")
+	get("/api/leaderboard")
+	rec := get("/api/leaderboard")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("Retry-After = %q, want 60", rec.Header().Get("Retry-After"))
+	}
+	if code := errorCode(t, rec); code != "rate_limited" {
+		t.Errorf("code = %q, want rate_limited", code)
+	}
+
+	expectStatus(t, get("/healthz"), http.StatusOK)
+}
+
+func TestUnsupportedContentType(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	for _, contentType := range []string{"text/plain", "multipart/form-data; boundary=x"} {
+		req := httptest.NewRequest("POST", "/api/game/create", strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handleCreateGame(rec, req)
+		if rec.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Content-Type %q: status %d, want 415", contentType, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/api/game/create", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handleCreateGame(rec, req)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestVersion(t *testing.T) {
+	rec := call(t, handleVersion, "GET", "/api/version", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	var info map[string]string
+	decode(t, rec, &info)
+	want := map[string]string{"version": "dev", "commit": "unknown", "go_version": runtime.Version()}
+	for key, value := range want {
+		if info[key] != value {
+			t.Errorf("%s = %q, want %q", key, info[key], value)
+		}
+	}
+
+	setVar(t, &version, "v1.2.3")
+	setVar(t, &commit, "abc1234")
+	rec = call(t, handleVersion, "GET", "/api/version", "", nil)
+	decode(t, rec, &info)
+	if info["version"] != "v1.2.3" || info["commit"] != "abc1234" {
+		t.Errorf("build info = %v, want the values set at build time", info)
+	}
+}
+
+// serveStatic runs a GET for urlPath through the static file handler,
+// serving the working directory like main does
+func serveStatic(urlPath string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	staticHandler(http.FileServer(http.Dir("."))).ServeHTTP(rec, httptest.NewRequest("GET", urlPath, nil))
+	return rec
+}
+
+// chdirSite makes a temporary directory holding an index.html the
+// working directory for the rest of a test
+func chdirSite(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("index.html", []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	setupServer(t)
+	chdirSite(t)
+	dataDir = "data"
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	store = &FileStore{path: filepath.Join(dataDir, "users.json")}
+
+	register(t, "alice")
+	if _, err := os.Stat(filepath.Join("data", "users.json")); err != nil {
+		t.Fatalf("users were not saved in the data directory: %v", err)
+	}
+	if _, err := os.Stat("users.json"); !os.IsNotExist(err) {
+		t.Error("users were saved outside the data directory")
+	}
+
+	for _, p := range []string{"/data/users.json", "/data/", "/data", "/x/../data/users.json"} {
+		if rec := serveStatic(p); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", p, rec.Code)
+		}
+	}
+	expectStatus(t, serveStatic("/"), http.StatusOK)
+}
+
+func TestStaticHidesDataFiles(t *testing.T) {
+	setupServer(t)
+	chdirSite(t)
+	dataDir = "."
+	for _, name := range []string{"users.json", "users.json.tmp"} {
+		if err := os.WriteFile(name, []byte(`{"users":{}}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{"/users.json", "/users.json.tmp", "/USERS.JSON", "/./users.json", "/images/../users.json"} {
+		if rec := serveStatic(p); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", p, rec.Code)
+		}
+	}
+	expectStatus(t, serveStatic("/"), http.StatusOK)
+}
+
+func TestStaticHidesAutocertCache(t *testing.T) {
+	setupServer(t)
+	chdirSite(t)
+	dataDir = "."
+	if err := os.MkdirAll(filepath.Join("autocert", "acme"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("autocert", "example.com"), []byte("PRIVATE KEY"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"/autocert", "/autocert/", "/autocert/example.com", "/AutoCert/example.com", "/autocert/acme/"} {
+		if rec := serveStatic(p); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", p, rec.Code)
+		}
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to
+// dir, returning their paths and the certificate for clients to trust
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t, t.TempDir())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	server := &http.Server{Handler: requestIDMiddleware(mux)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, certFile, keyFile)
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	resp, err := client.Get("https://" + ln.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || body["status"] != "ok" || resp.TLS == nil {
+		t.Errorf("GET /healthz over TLS: %d %v", resp.StatusCode, body)
+	}
+}
+
+func TestGameTTL(t *testing.T) {
+	setupServer(t)
+	setVar(t, &gameTTL, 2*time.Minute)
+	room := createGame(t, register(t, "alice"), nil)
+	now := time.Now().UTC()
+
+	sweepOldGames(now.Add(time.Minute))
+	if games.rooms[room.ID] == nil {
+		t.Fatal("room was removed before the TTL")
+	}
+
+	sweepOldGames(now.Add(3 * time.Minute))
+	if games.rooms[room.ID] != nil || games.codes[room.Code] != "" {
+		t.Error("stale room survived a sweep past the TTL")
+	}
+}
+
+func TestFinishedMoveCountAndDuration(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	room.StartedAt = room.StartedAt.Add(-90 * time.Second)
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+
+	state := getState(t, room, tokenX)
+	if state.Status != "finished" || state.FinishedAt.IsZero() {
+		t.Fatalf("status %s, finished at %v; want a finished game", state.Status, state.FinishedAt)
+	}
+	if state.MoveCount != 5 {
+		t.Errorf("move_count = %d, want 5", state.MoveCount)
+	}
+	if state.Duration < 90 || state.Duration > 91 {
+		t.Errorf("duration_seconds = %.1f, want about 90", state.Duration)
+	}
+
+	// A finished game's duration stops growing
+	time.Sleep(10 * time.Millisecond)
+	if again := getState(t, room, tokenX); again.Duration != state.Duration {
+		t.Errorf("duration went from %f to %f after the game ended", state.Duration, again.Duration)
+	}
+}
+
+// guest starts a guest session, returning its token and user
+func guest(t *testing.T) (string, User) {
+	t.Helper()
+	rec := call(t, handleGuest, "POST", "/api/guest", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	var resp struct {
+		Token string `json:"token"`
+		User  User   `json:"user"`
+	}
+	decode(t, rec, &resp)
+	return resp.Token, resp.User
+}
+
+func TestGuestPlay(t *testing.T) {
+	setupServer(t)
+	tokenX, guestUser := guest(t)
+	if !guestUser.Guest || !strings.HasPrefix(guestUser.Username, "Guest-") || len(guestUser.Username) != len("Guest-")+6 {
+		t.Fatalf("guest user = %+v", guestUser)
+	}
+
+	tokenO := register(t, "bob")
+	room := createGame(t, tokenX, nil)
+	joinGame(t, tokenO, room.Code)
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+	if room.Winner != "X" {
+		t.Fatalf("winner = %q, want the guest", room.Winner)
+	}
+
+	for _, user := range leaderboard(t, "") {
+		if user.Username == guestUser.Username {
+			t.Error("guest appears on the leaderboard")
+		}
+	}
+	users, err := store.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users[guestUser.ID] != nil {
+		t.Error("guest was saved")
+	}
+
+	// A guest name can't be taken by a registration
+	rec := call(t, handleRegister, "POST", "/api/register", "", map[string]string{"username": "guest-abc"})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestGuestRemovedWhenSessionEnds(t *testing.T) {
+	t.Run("logout", func(t *testing.T) {
+		setupServer(t)
+		token, user := guest(t)
+
+		expectStatus(t, call(t, handleLogout, "POST", "/api/logout", token, nil), http.StatusOK)
+		if db.Users[user.ID] != nil {
+			t.Error("guest account survived logout")
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		setupServer(t)
+		sessions.max = 1
+		_, user := guest(t)
+
+		register(t, "alice")
+		if db.Users[user.ID] != nil {
+			t.Error("guest account survived its session's eviction")
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		setupServer(t)
+		token, user := guest(t)
+		register(t, "alice")
+
+		sweepGuests(time.Now().UTC().Add(guestTTL + time.Minute))
+		if db.Users[user.ID] != nil {
+			t.Error("guest account survived its TTL")
+		}
+		expectStatus(t, call(t, handleGetUser, "GET", "/api/user", token, nil), http.StatusUnauthorized)
+		if findUserByUsername("alice") == nil {
+			t.Error("registered user was removed with the guests")
+		}
+	})
+}
+
+func TestTurnTimeoutPolicies(t *testing.T) {
+	t.Run("forfeit", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, _ := startGameFor(t, map[string]interface{}{"turn_seconds": 10})
+		room.TurnStartedAt = room.TurnStartedAt.Add(-11 * time.Second)
+
+		state := getState(t, room, tokenX)
+		if state.Status != "finished" || state.Winner != "O" || state.ForfeitedBy != "X" {
+			t.Errorf("status %s, winner %q, forfeited by %q; want X to forfeit", state.Status, state.Winner, state.ForfeitedBy)
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"turn_seconds": 10, "timeout_policy": "skip"})
+		room.TurnStartedAt = room.TurnStartedAt.Add(-11 * time.Second)
+
+		state := getState(t, room, tokenX)
+		if state.Status != "playing" || state.CurrentTurn != "O" {
+			t.Fatalf("status %s, turn %s; want O to move", state.Status, state.CurrentTurn)
+		}
+		if len(state.SkippedTurns) != 1 || state.SkippedTurns[0].Symbol != "X" {
+			t.Errorf("skipped turns = %+v, want X's", state.SkippedTurns)
+		}
+
+		// The skipped player can't move; the opponent can
+		rec := move(t, room, tokenX, 4)
+		expectStatus(t, rec, http.StatusBadRequest)
+		expectStatus(t, move(t, room, tokenO, 4), http.StatusOK)
+	})
+
+	t.Run("skip repeatedly", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, _ := startGameFor(t, map[string]interface{}{"turn_seconds": 10, "timeout_policy": "skip"})
+		room.TurnStartedAt = room.TurnStartedAt.Add(-25 * time.Second)
+
+		state := getState(t, room, tokenX)
+		if state.CurrentTurn != "X" || len(state.SkippedTurns) != 2 {
+			t.Errorf("turn %s after %d skips; want X to move after 2", state.CurrentTurn, len(state.SkippedTurns))
+		}
+	})
+}
+
+// stateDiffSince fetches what changed in room since version
+func stateDiffSince(t *testing.T, room *GameRoom, token string, version int) stateDiff {
+	t.Helper()
+	rec := call(t, handleGameStateDiff, "GET", fmt.Sprintf("/api/game/state-diff?room_id=%s&since_version=%d", room.ID, version), token, nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	var diff stateDiff
+	decode(t, rec, &diff)
+	return diff
+}
+
+func TestStateDiff(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	start := room.Version
+
+	if diff := stateDiffSince(t, room, tokenX, start); diff.Version != start || diff.Cells != nil || diff.CurrentTurn != "" || diff.Full != nil {
+		t.Errorf("diff with no change = %+v, want empty", diff)
+	}
+
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+	diff := stateDiffSince(t, room, tokenX, start)
+	if len(diff.Cells) != 1 || diff.Cells[4] != "X" || diff.CurrentTurn != "O" || diff.Status != "" {
+		t.Errorf("diff after one move = %+v", diff)
+	}
+
+	playTurns(t, room, tokenO, tokenX, 0, 8)
+	diff = stateDiffSince(t, room, tokenX, start)
+	if len(diff.Cells) != 3 || diff.Cells[0] != "O" || diff.Cells[8] != "X" || diff.CurrentTurn != "O" {
+		t.Errorf("diff after three moves = %+v", diff)
+	}
+	if diff.Version != room.Version {
+		t.Errorf("diff version = %d, want %d", diff.Version, room.Version)
+	}
+
+	// A diff from a later version only holds what changed since then
+	since := room.Version
+	expectStatus(t, move(t, room, tokenO, 1), http.StatusOK)
+	diff = stateDiffSince(t, room, tokenX, since)
+	if len(diff.Cells) != 1 || diff.Cells[1] != "O" || diff.CurrentTurn != "X" {
+		t.Errorf("diff after O's move = %+v", diff)
+	}
+
+	rec := call(t, handleGameStateDiff, "GET", "/api/game/state-diff?room_id="+room.ID+"&since_version=-1", tokenX, nil)
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestStateDiffWin(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4)
+	since := room.Version
+
+	expectStatus(t, move(t, room, tokenX, 2), http.StatusOK)
+	diff := stateDiffSince(t, room, tokenX, since)
+	if diff.Status != "finished" || diff.Winner != "X" || len(diff.WinningLine) != 3 || diff.Cells[2] != "X" {
+		t.Errorf("diff after the winning move = %+v", diff)
+	}
+}
+
+func TestStateDiffFallsBackToFullState(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"board_size": 7})
+	start := room.Version
+
+	// Emotes change the version without touching the board
+	for i := 0; i < diffHistory; i++ {
+		expectStatus(t, sendEmote(t, room, tokenO, "deal_with_it"), http.StatusOK)
+	}
+
+	diff := stateDiffSince(t, room, tokenX, start)
+	if diff.Full == nil || diff.Full.ID != room.ID || diff.Full.YourSymbol != "X" {
+		t.Errorf("diff from too far back = %+v, want the full state", diff)
+	}
+}
+
+// adminRequest sends a request through admin routes like main's, with
+// the given Authorization header
+func adminRequest(method, target, auth string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/admin/games", handleAdminGames)
+	mux.HandleFunc("/api/admin/games/{id}", handleAdminDeleteGame)
+
+	req := httptest.NewRequest(method, target, nil)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	setupServer(t)
+	room, _, _ := startGameFor(t, nil)
+
+	setVar(t, &adminToken, "")
+	expectStatus(t, adminRequest("GET", "/api/admin/games", "Bearer "), http.StatusForbidden)
+
+	setVar(t, &adminToken, "s3cret")
+	for _, auth := range []string{"", "Bearer wrong", "Bearer s3cre", "Basic s3cret"} {
+		if rec := adminRequest("GET", "/api/admin/games", auth); rec.Code != http.StatusForbidden {
+			t.Errorf("Authorization %q: status %d, want 403", auth, rec.Code)
+		}
+		if rec := adminRequest("DELETE", "/api/admin/games/"+room.ID, auth); rec.Code != http.StatusForbidden {
+			t.Errorf("delete with Authorization %q: status %d, want 403", auth, rec.Code)
+		}
+	}
+	if games.rooms[room.ID] == nil {
+		t.Error("unauthorized delete removed the room")
+	}
+}
+
+func TestAdminGames(t *testing.T) {
+	setupServer(t)
+	setVar(t, &adminToken, "s3cret")
+	playing, tokenX, _ := startGameFor(t, nil)
+	waiting := createGame(t, tokenX, nil)
+
+	rec := adminRequest("GET", "/api/admin/games", "Bearer s3cret")
+	expectStatus(t, rec, http.StatusOK)
+	var list struct {
+		Games []GameRoom `json:"games"`
+		Count int        `json:"count"`
+	}
+	decode(t, rec, &list)
+	if list.Count != 2 || len(list.Games) != 2 {
+		t.Fatalf("listed %d games (count %d), want 2", len(list.Games), list.Count)
+	}
+	if list.Games[0].ID != playing.ID || list.Games[1].ID != waiting.ID {
+		t.Errorf("games listed out of creation order")
+	}
+	if list.Games[0].PlayerO == nil || list.Games[0].PlayerO.Username != "bob" {
+		t.Errorf("listing is missing room details: %+v", list.Games[0])
+	}
+
+	expectStatus(t, adminRequest("DELETE", "/api/admin/games/"+playing.ID, "Bearer s3cret"), http.StatusOK)
+	if games.rooms[playing.ID] != nil || games.codes[playing.Code] != "" {
+		t.Error("deleted room is still stored")
+	}
+	expectStatus(t, adminRequest("DELETE", "/api/admin/games/"+playing.ID, "Bearer s3cret"), http.StatusNotFound)
+}
+
+// TestAdminGamesDuringPlay lists games while they are being played; run
+// it with -race to check the listing doesn't read rooms unlocked
+func TestAdminGamesDuringPlay(t *testing.T) {
+	setupServer(t)
+	setVar(t, &adminToken, "s3cret")
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"board_size": 7})
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			token := tokenX
+			if i%2 == 1 {
+				token = tokenO
+			}
+			// Called off the test goroutine, so check without t.Fatal
+			rec := call(t, handleGameMove, "POST", "/api/game/move", token, map[string]interface{}{"room_id": room.ID, "index": i})
+			if rec.Code != http.StatusOK {
+				t.Errorf("move %d: status %d", i, rec.Code)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		expectStatus(t, adminRequest("GET", "/api/admin/games", "Bearer s3cret"), http.StatusOK)
+	}
+	<-done
+}
+
+func TestOnGameFinished(t *testing.T) {
+	setupServer(t)
+	var results []GameResult
+	games.OnGameFinished = func(result GameResult) { results = append(results, result) }
+
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"board_size": 4, "win_length": 3, "total_seconds": 60})
+	if len(results) != 0 {
+		t.Fatalf("event emitted before the game finished: %+v", results)
+	}
+	playTurns(t, room, tokenX, tokenO, 0, 4, 1, 5, 2)
+
+	if len(results) != 1 {
+		t.Fatalf("got %d events, want 1", len(results))
+	}
+	got := results[0]
+	want := GameResult{Code: room.Code, BoardSize: 4, WinLength: 3, Mode: "timed", Winner: "X", MoveCount: 5}
+	got.Duration = 0
+	if got != want {
+		t.Errorf("result = %+v, want %+v", got, want)
+	}
+	if results[0].Duration < 0 {
+		t.Errorf("negative duration %v", results[0].Duration)
+	}
+
+	// A draw in an untimed game
+	results = nil
+	tokenC := register(t, "carol")
+	draw := createGame(t, tokenO, nil)
+	joinGame(t, tokenC, draw.Code)
+	playTurns(t, draw, tokenO, tokenC, 0, 1, 2, 4, 3, 5, 7, 6, 8)
+	if len(results) != 1 || results[0].Winner != "draw" || results[0].Mode != "untimed" || results[0].MoveCount != 9 {
+		t.Errorf("draw result = %+v", results)
+	}
+}
+
+// memStore is a Store holding copies of users in memory, for tests that
+// don't need a file. Saves fail with err when it is set.
+type memStore struct {
+	users map[string]User
+	saves int
+	err   error
+}
+
+func newMemStore() *memStore {
+	return &memStore{users: make(map[string]User)}
+}
+
+func (s *memStore) LoadUsers() (map[string]*User, error) {
+	users := make(map[string]*User, len(s.users))
+	for id, user := range s.users {
+		user := user
+		users[id] = &user
+	}
+	return users, nil
+}
+
+func (s *memStore) SaveUsers(users ...*User) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.saves++
+	for _, user := range users {
+		s.users[user.ID] = *user
+	}
+	return nil
+}
+
+func TestHandlersUseStore(t *testing.T) {
+	setupServer(t)
+	mem := newMemStore()
+	store = mem
+
+	token := register(t, "alice")
+	rec := call(t, handleUpdateScore, "POST", "/api/score", token, map[string]string{"result": "win"})
+	expectStatus(t, rec, http.StatusOK)
+	if mem.saves != 2 {
+		t.Errorf("store saved %d times, want 2 (register and score)", mem.saves)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "users.json")); !os.IsNotExist(err) {
+		t.Errorf("users.json written with a memory store: %v", err)
+	}
+
+	// A restart reloads what the store kept
+	db = &Database{Users: make(map[string]*User)}
+	loadDatabase()
+	var alice *User
+	for _, user := range db.Users {
+		if user.Username == "alice" {
+			alice = user
+		}
+	}
+	if alice == nil || alice.Scores.Wins != 1 {
+		t.Fatalf("reloaded alice = %+v", alice)
+	}
+
+	mem.err = errors.New("store offline")
+	rec = call(t, handleUpdateScore, "POST", "/api/score", token, map[string]string{"result": "win"})
+	expectStatus(t, rec, http.StatusInternalServerError)
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	fs := &FileStore{path: filepath.Join(t.TempDir(), "users.json")}
+	users, err := fs.LoadUsers()
+	if err != nil || len(users) != 0 {
+		t.Fatalf("LoadUsers on a missing file = %v, %v", users, err)
+	}
+
+	alice := &User{ID: "a1", Username: "alice", Scores: Scores{Wins: 2}}
+	bob := &User{ID: "b1", Username: "bob"}
+	if err := fs.SaveUsers(alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	alice.Scores.Wins = 3
+	if err := fs.SaveUsers(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err = fs.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["a1"].Scores.Wins != 3 || users["b1"].Username != "bob" {
+		t.Errorf("reloaded users = %+v", users)
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	setupServer(t)
+	path := filepath.Join(dataDir, "game.db")
+	ss, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = ss
+
+	token := register(t, "alice")
+	for _, result := range []string{"win", "win", "draw"} {
+		rec := call(t, handleUpdateScore, "POST", "/api/score", token, map[string]string{"result": result})
+		expectStatus(t, rec, http.StatusOK)
+	}
+	ss.conn.Close()
+
+	// Reopening doesn't migrate again, and finds alice's latest scores
+	ss, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.conn.Close()
+	var version int
+	if err := ss.conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != len(sqliteMigrations) {
+		t.Errorf("schema version = %d, %v; want %d", version, err, len(sqliteMigrations))
+	}
+
+	users, err := ss.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("loaded %d users, want 1", len(users))
+	}
+	for _, user := range users {
+		if user.Username != "alice" || user.Scores != (Scores{Wins: 2, Draws: 1}) {
+			t.Errorf("loaded %+v", user)
+		}
+		if user.CreatedAt.IsZero() || user.CreatedAt.Location() != time.UTC {
+			t.Errorf("created_at = %v", user.CreatedAt)
+		}
+	}
+}
+
+func TestFinishSavesBothPlayersTogether(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	mem := newMemStore()
+	store = mem
+
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+	if mem.saves != 1 {
+		t.Errorf("finish saved %d times, want once", mem.saves)
+	}
+	if mem.users[room.PlayerX.ID].Scores.Wins != 1 || mem.users[room.PlayerO.ID].Scores.Losses != 1 {
+		t.Errorf("saved users = %+v", mem.users)
+	}
+}
+
+func TestFinishSaveFailureSavesNeither(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	failWrites(t)
+
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+	for _, name := range []string{"alice", "bob"} {
+		if saved := savedUser(t, name); saved.Scores != (Scores{}) {
+			t.Errorf("%s's scores saved despite the failure: %+v", name, saved.Scores)
+		}
+	}
+}
+
+func TestSQLiteSaveUsersIsOneTransaction(t *testing.T) {
+	ss, err := openSQLiteStore(filepath.Join(t.TempDir(), "game.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.conn.Close()
+
+	alice := &User{ID: "a1", Username: "alice", CreatedAt: time.Now().UTC()}
+	bob := &User{ID: "b1", Username: "bob", CreatedAt: time.Now().UTC()}
+	if err := ss.SaveUsers(alice, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second update breaks the unique username, so the first must not
+	// be applied either
+	alice.Scores.Wins = 1
+	clash := &User{ID: "c1", Username: "bob", CreatedAt: time.Now().UTC()}
+	if err := ss.SaveUsers(alice, clash); err == nil {
+		t.Fatal("saving a duplicate username succeeded")
+	}
+
+	users, err := ss.LoadUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["a1"].Scores.Wins != 0 {
+		t.Errorf("partial update persisted: %+v", users)
+	}
+}
+
+func TestWinRevealAt(t *testing.T) {
+	setupServer(t)
+	setVar(t, &winRevealDelay, 2*time.Second)
+
+	won, tokenX, tokenO := startGameFor(t, nil)
+	playTurns(t, won, tokenX, tokenO, 0, 3, 1, 4, 2)
+	if d := won.WinRevealAt.Sub(won.FinishedAt); d != 2*time.Second {
+		t.Errorf("win revealed %v after the finish, want 2s", d)
+	}
+	if won.Winner != "X" || won.Status != "finished" {
+		t.Errorf("result not immediate: winner %q, status %q", won.Winner, won.Status)
+	}
+
+	// A draw has no line to show
+	drawn := createGame(t, tokenO, nil)
+	joinGame(t, tokenX, drawn.Code)
+	playTurns(t, drawn, tokenO, tokenX, 0, 1, 2, 4, 3, 5, 7, 6, 8)
+	if !drawn.WinRevealAt.Equal(drawn.FinishedAt) {
+		t.Errorf("draw reveals at %v, finished at %v", drawn.WinRevealAt, drawn.FinishedAt)
+	}
+
+	if state := getState(t, won, tokenX); !state.WinRevealAt.Equal(won.WinRevealAt) {
+		t.Errorf("state reveals at %v, want %v", state.WinRevealAt, won.WinRevealAt)
+	}
+}
+
+func TestValidateRoom(t *testing.T) {
+	tests := []struct {
+		name  string
+		board string
+		skips []TurnSkip
+		valid bool
+	}{
+		{"empty", ".........", nil, true},
+		{"X to move", "XO.......", nil, true},
+		{"O to move", "XOX......", nil, true},
+		{"X won", "XXXOO....", nil, true},
+		{"O skipped", "XX.O.....", []TurnSkip{{Symbol: "O"}}, true},
+		{"two extra X", "XXXO.....", nil, false},
+		{"O first", "O........", nil, false},
+		{"double win", "XXXOOO...", nil, false},
+		{"unknown symbol", "XZ.......", nil, false},
+		{"wrong size", "XO..", nil, false},
+	}
+	for _, tt := range tests {
+		room := newPlayingRoom(3, &User{ID: "x"}, &User{ID: "o"})
+		room.Board = cells(tt.board)
+		room.SkippedTurns = tt.skips
+		if err := validateRoom(room); (err == nil) != tt.valid {
+			t.Errorf("%s: validateRoom = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestMoveOnImpossibleBoard(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+	room.Board = cells("XXX......")
+
+	rec := call(t, handleGameMove, "POST", "/api/game/move", tokenX, map[string]interface{}{"room_id": room.ID, "index": 4})
+	expectStatus(t, rec, http.StatusInternalServerError)
+	if code := errorCode(t, rec); code != "invalid_room_state" {
+		t.Errorf("error code %q, want invalid_room_state", code)
+	}
+}
+
+// hint asks for a hint in room, returning the recorder
+func hint(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleGameHint, "GET", "/api/game/hint?room_id="+room.ID, token, nil)
+}
+
+func TestGameHint(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+
+	var resp struct {
+		Index, Row, Col int
+	}
+	rec := hint(t, room, tokenX)
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &resp)
+	if resp.Index < 0 || resp.Index >= 9 || room.Board[resp.Index] != "" {
+		t.Errorf("hint %d is not an empty cell", resp.Index)
+	}
+	if resp.Row != resp.Index/3 || resp.Col != resp.Index%3 {
+		t.Errorf("hint at row %d col %d, index %d", resp.Row, resp.Col, resp.Index)
+	}
+
+	// Known positions: X completes the top row, O must block it, and O
+	// must answer opposite corners with an edge
+	tests := []struct {
+		board, turn, token string
+		want               []int
+	}{
+		{"XX.OO....", "X", tokenX, []int{2}},
+		{"XX.O.....", "O", tokenO, []int{2}},
+		{"X...O...X", "O", tokenO, []int{1, 3, 5, 7}},
+	}
+	for _, tt := range tests {
+		room.Board = cells(tt.board)
+		room.CurrentTurn = tt.turn
+		rec := hint(t, room, tt.token)
+		expectStatus(t, rec, http.StatusOK)
+		decode(t, rec, &resp)
+		if !slices.Contains(tt.want, resp.Index) {
+			t.Errorf("%s: hint %d, want one of %v", tt.board, resp.Index, tt.want)
+		}
+	}
+
+	expectStatus(t, hint(t, room, tokenX), http.StatusBadRequest)
+	expectStatus(t, hint(t, room, register(t, "carol")), http.StatusForbidden)
+}
+
+func TestGameHintLimits(t *testing.T) {
+	setupServer(t)
+	hintLimiter.limit = 2
+	room, tokenX, tokenO := startGameFor(t, nil)
+	for i := 0; i < 2; i++ {
+		expectStatus(t, hint(t, room, tokenX), http.StatusOK)
+	}
+	rec := hint(t, room, tokenX)
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("rate limited hint has no Retry-After")
+	}
+
+	ranked := createGame(t, tokenO, map[string]interface{}{"hints_disabled": true})
+	joinGame(t, tokenX, ranked.Code)
+	rec = hint(t, ranked, tokenO)
+	expectStatus(t, rec, http.StatusForbidden)
+	if code := errorCode(t, rec); code != "hints_disabled" {
+		t.Errorf("error code %q, want hints_disabled", code)
+	}
+}
+
+// setPreferences posts prefs for the holder of token
+func setPreferences(t *testing.T, token string, prefs map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handlePreferences, "POST", "/api/user/preferences", token, map[string]interface{}{"preferences": prefs})
+}
+
+func TestPreferencesMerge(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	expectStatus(t, setPreferences(t, token, map[string]string{"theme": "dark", "board_size": "4"}), http.StatusOK)
+	expectStatus(t, setPreferences(t, token, map[string]string{"emote": "gg", "board_size": ""}), http.StatusOK)
+
+	rec := call(t, handlePreferences, "GET", "/api/user/preferences", token, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var resp struct {
+		Preferences map[string]string `json:"preferences"`
+	}
+	decode(t, rec, &resp)
+	want := map[string]string{"theme": "dark", "emote": "gg"}
+	if fmt.Sprint(resp.Preferences) != fmt.Sprint(want) {
+		t.Errorf("preferences = %v, want %v", resp.Preferences, want)
+	}
+	if saved := savedUser(t, "alice"); fmt.Sprint(saved.Preferences) != fmt.Sprint(want) {
+		t.Errorf("saved preferences = %v, want %v", saved.Preferences, want)
+	}
+}
+
+func TestPreferencesLimits(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	for _, prefs := range []map[string]string{
+		{"": "x"},
+		{strings.Repeat("k", maxPreferenceKeyLen+1): "x"},
+		{"theme": strings.Repeat("v", maxPreferenceValueLen+1)},
+	} {
+		rec := setPreferences(t, token, prefs)
+		expectStatus(t, rec, http.StatusBadRequest)
+		if code := errorCode(t, rec); code != "invalid_preference" {
+			t.Errorf("error code %q, want invalid_preference", code)
+		}
+	}
+
+	prefs := map[string]string{}
+	for i := 0; i < maxPreferences; i++ {
+		prefs[fmt.Sprintf("key%d", i)] = "x"
+	}
+	expectStatus(t, setPreferences(t, token, prefs), http.StatusOK)
+	rec := setPreferences(t, token, map[string]string{"one_more": "x"})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if code := errorCode(t, rec); code != "too_many_preferences" {
+		t.Errorf("error code %q, want too_many_preferences", code)
+	}
+	if n := len(savedUser(t, "alice").Preferences); n != maxPreferences {
+		t.Errorf("%d preferences saved, want %d", n, maxPreferences)
+	}
+}
+
+func TestDoubleLeave(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	playTurns(t, room, tokenX, tokenO, 0, 4)
+
+	// Both players leave at once; whoever is first forfeits
+	codes := make(chan int, 2)
+	for _, token := range []string{tokenX, tokenO} {
+		go func(token string) {
+			codes <- leave(t, room, token).Code
+		}(token)
+	}
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("leave status %d, want 200", code)
+		}
+	}
+
+	if games.rooms[room.ID] == nil {
+		t.Fatal("room removed before the winner could see the result")
+	}
+	if room.Status != "finished" || room.Winner == "" {
+		t.Errorf("status %q, winner %q", room.Status, room.Winner)
+	}
+	wins := room.PlayerX.Scores.Wins + room.PlayerO.Scores.Wins
+	if wins != 1 {
+		t.Errorf("%d wins recorded, want 1", wins)
+	}
+
+	// Leaving again changes nothing
+	expectStatus(t, leave(t, room, tokenX), http.StatusOK)
+	if games.rooms[room.ID] == nil || room.PlayerX.Scores.Wins+room.PlayerO.Scores.Wins != 1 {
+		t.Error("a repeated leave changed the result")
+	}
+
+	sweepOldGames(room.FinishedAt.Add(finishedRetention + time.Second))
+	if games.rooms[room.ID] != nil {
+		t.Error("room kept after the retention period")
+	}
+}
+
+func TestLeaveFinishedRoomAsStranger(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+	expectStatus(t, leave(t, room, tokenX), http.StatusOK)
+	stranger := register(t, "carol")
+
+	expectStatus(t, leave(t, room, stranger), http.StatusForbidden)
+	if room.departed[findUserByUsername("carol").ID] {
+		t.Error("a stranger was recorded as leaving the room")
+	}
+
+	// Nor can a stranger remove the room once it could be removed
+	room.FinishedAt = room.FinishedAt.Add(-finishedRetention - time.Second)
+	expectStatus(t, leave(t, room, stranger), http.StatusForbidden)
+	if games.rooms[room.ID] == nil {
+		t.Error("a stranger removed the finished room")
+	}
+}
+
+func TestCustomSymbols(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"symbol_x": "🔥", "symbol_o": "AB"})
+
+	state := getState(t, room, tokenO)
+	if state.SymbolX != "🔥" || state.SymbolO != "AB" || state.YourSymbol != "O" {
+		t.Errorf("state symbols %q/%q, yours %q", state.SymbolX, state.SymbolO, state.YourSymbol)
+	}
+
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+	if room.Board[0] != "X" || room.Board[3] != "O" {
+		t.Errorf("board holds %q and %q, want X and O", room.Board[0], room.Board[3])
+	}
+	if room.Winner != "X" || room.PlayerX.Scores.Wins != 1 || room.PlayerO.Scores.Losses != 1 {
+		t.Errorf("winner %q, scores %+v and %+v", room.Winner, room.PlayerX.Scores, room.PlayerO.Scores)
+	}
+
+	// Unset symbols default to X and O
+	plain := createGame(t, tokenX, nil)
+	if plain.SymbolX != "X" || plain.SymbolO != "O" {
+		t.Errorf("default symbols %q/%q", plain.SymbolX, plain.SymbolO)
+	}
+}
+
+func TestCustomSymbolsValidation(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+	for _, opts := range []map[string]string{
+		{"symbol_x": "abc"},
+		{"symbol_x": " "},
+		{"symbol_x": "O"},
+		{"symbol_x": "🔥", "symbol_o": "🔥"},
+	} {
+		rec := call(t, handleCreateGame, "POST", "/api/game/create", token, opts)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want 400", opts, rec.Code)
+		}
+	}
+	if len(games.rooms) != 0 {
+		t.Errorf("%d rooms created from invalid symbols", len(games.rooms))
+	}
+}
+
+func TestWaitingRoomExpiry(t *testing.T) {
+	setupServer(t)
+	setVar(t, &gameTTL, 10*time.Minute)
+	token := register(t, "alice")
+	room := createGame(t, token, nil)
+
+	state := getState(t, room, token)
+	if state.ExpiresAt == nil {
+		t.Fatal("waiting room has no expires_at")
+	}
+	if want := room.UpdatedAt.Add(10 * time.Minute); !state.ExpiresAt.Equal(want) {
+		t.Errorf("expires_at = %v, want %v", state.ExpiresAt, want)
+	}
+
+	// The room survives until just past its expiry
+	sweepOldGames(state.ExpiresAt.Add(-time.Second))
+	if games.rooms[room.ID] == nil {
+		t.Fatal("room removed before expires_at")
+	}
+	sweepOldGames(state.ExpiresAt.Add(time.Second))
+	if games.rooms[room.ID] != nil {
+		t.Error("room kept past expires_at")
+	}
+
+	started := createGame(t, token, nil)
+	joinGame(t, register(t, "bob"), started.Code)
+	if getState(t, started, token).ExpiresAt != nil {
+		t.Error("a game in progress reports expires_at")
+	}
+}
+
+// newCode asks for a new join code for room
+func newCode(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleNewGameCode, "POST", "/api/game/new-code", token, map[string]string{"room_id": room.ID})
+}
+
+func TestNewGameCode(t *testing.T) {
+	setupServer(t)
+	host := register(t, "alice")
+	other := register(t, "bob")
+	room := createGame(t, host, nil)
+	oldCode := room.Code
+
+	expectStatus(t, newCode(t, room, other), http.StatusForbidden)
+
+	rec := newCode(t, room, host)
+	expectStatus(t, rec, http.StatusOK)
+	var state gameStateResponse
+	decode(t, rec, &state)
+	if state.Code == oldCode || state.Code != room.Code {
+		t.Fatalf("new code %q (room %q), old %q", state.Code, room.Code, oldCode)
+	}
+	if _, ok := games.codes[oldCode]; ok {
+		t.Error("old code still stored")
+	}
+
+	rec = call(t, handleJoinGame, "POST", "/api/game/join", other, map[string]string{"code": oldCode})
+	expectStatus(t, rec, http.StatusNotFound)
+	joinGame(t, other, state.Code)
+
+	rec = newCode(t, room, host)
+	expectStatus(t, rec, http.StatusConflict)
+}
+
+func TestMisconfiguredBoard(t *testing.T) {
+	for _, size := range []int{2, 4} {
+		setupServer(t)
+		room, tokenX, _ := startGameFor(t, nil)
+		room.BoardSize = size
+
+		rec := call(t, handleGameMove, "POST", "/api/game/move", tokenX, map[string]interface{}{"room_id": room.ID, "index": 8})
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if code := errorCode(t, rec); code != "board_misconfigured" {
+			t.Errorf("size %d: move error code %q, want board_misconfigured", size, code)
+		}
+		if room.Board[8] != "" || room.CurrentTurn != "X" {
+			t.Errorf("size %d: the move was applied", size)
+		}
+
+		rec = hint(t, room, tokenX)
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if code := errorCode(t, rec); code != "board_misconfigured" {
+			t.Errorf("size %d: hint error code %q, want board_misconfigured", size, code)
+		}
+	}
+}
+
+// confirm commits the pending move of the holder of token
+func confirm(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleConfirmMove, "POST", "/api/game/confirm", token, map[string]string{"room_id": room.ID})
+}
+
+func TestConfirmMoves(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"confirm_moves": true})
+
+	expectStatus(t, confirm(t, room, tokenX), http.StatusBadRequest)
+
+	expectStatus(t, move(t, room, tokenX, 0), http.StatusOK)
+	if room.Board[0] != "" || room.CurrentTurn != "X" {
+		t.Fatal("a pending move was placed")
+	}
+	if p := getState(t, room, tokenX).PendingMove; p == nil || *p != 0 {
+		t.Errorf("X sees pending move %v, want 0", p)
+	}
+	if p := getState(t, room, tokenO).PendingMove; p != nil {
+		t.Errorf("O sees X's pending move %d", *p)
+	}
+
+	// A different cell replaces the pending move
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+	if p := getState(t, room, tokenX).PendingMove; p == nil || *p != 4 {
+		t.Errorf("pending move %v after changing it, want 4", p)
+	}
+
+	// The opponent can't confirm it, nor propose out of turn
+	expectStatus(t, confirm(t, room, tokenO), http.StatusBadRequest)
+	expectStatus(t, move(t, room, tokenO, 1), http.StatusBadRequest)
+
+	expectStatus(t, confirm(t, room, tokenX), http.StatusOK)
+	if room.Board[4] != "X" || room.Board[0] != "" || room.CurrentTurn != "O" {
+		t.Errorf("board %q, turn %s after confirming", room.Board, room.CurrentTurn)
+	}
+	if p := getState(t, room, tokenO).PendingMove; p != nil {
+		t.Errorf("pending move %d carried over to O", *p)
+	}
+	expectStatus(t, confirm(t, room, tokenO), http.StatusBadRequest)
+
+	// Proposals are checked like moves
+	expectStatus(t, move(t, room, tokenO, 4), http.StatusBadRequest)
+}
+
+func TestLeaderboardSince(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	rec := call(t, handleLeaderboard, "GET", "/api/leaderboard", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	version := rec.Header().Get("X-Leaderboard-Version")
+	if version == "" {
+		t.Fatal("no X-Leaderboard-Version header")
+	}
+
+	// Nothing changed
+	rec = call(t, handleLeaderboard, "GET", "/api/leaderboard?since="+version, "", nil)
+	expectStatus(t, rec, http.StatusNotModified)
+	if rec.Body.Len() != 0 {
+		t.Errorf("304 has a body: %s", rec.Body)
+	}
+
+	expectStatus(t, call(t, handleUpdateScore, "POST", "/api/score", token, map[string]string{"result": "win"}), http.StatusOK)
+	rec = call(t, handleLeaderboard, "GET", "/api/leaderboard?since="+version, "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("X-Leaderboard-Version") == version {
+		t.Error("version unchanged after a score change")
+	}
+	var users []User
+	decode(t, rec, &users)
+	if len(users) != 1 || users[0].Scores.Wins != 1 {
+		t.Errorf("leaderboard = %+v", users)
+	}
+
+	rec = call(t, handleLeaderboard, "GET", "/api/leaderboard?since=yesterday", "", nil)
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+// threats fetches the winning cells of each player in room
+func threats(t *testing.T, room *GameRoom) (*httptest.ResponseRecorder, map[string][]int) {
+	t.Helper()
+	rec := call(t, handleGameThreats, "GET", "/api/game/threats?room_id="+room.ID, "", nil)
+	var cells map[string][]int
+	if rec.Code == http.StatusOK {
+		decode(t, rec, &cells)
+	}
+	return rec, cells
+}
+
+func TestGameThreats(t *testing.T) {
+	setupServer(t)
+	room, _, _ := startGameFor(t, map[string]interface{}{"board_size": 4, "win_length": 3})
+
+	tests := []struct {
+		board string
+		x, o  []int
+	}{
+		{"................", []int{}, []int{}},
+		{"XO..............", []int{}, []int{}},
+		// X threatens both ends of a row, a column, and a diagonal; O
+		// both ends of a column
+		{".XX.O.X.O.......", []int{0, 3, 10, 11}, []int{0, 12}},
+	}
+	for _, tt := range tests {
+		room.Board = cells(tt.board)
+		rec, got := threats(t, room)
+		expectStatus(t, rec, http.StatusOK)
+		if fmt.Sprint(got["X"]) != fmt.Sprint(tt.x) || fmt.Sprint(got["O"]) != fmt.Sprint(tt.o) {
+			t.Errorf("%s: threats X %v O %v, want X %v O %v", tt.board, got["X"], got["O"], tt.x, tt.o)
+		}
+	}
+}
+
+func TestGameThreatsHintsDisabled(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"hints_disabled": true})
+	rec, _ := threats(t, room)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	// Once the game is over there is nothing left to help with
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+	rec, _ = threats(t, room)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestForfeitScoring(t *testing.T) {
+	forfeits := []struct {
+		how     string
+		forfeit func(t *testing.T, room *GameRoom, tokenX string)
+	}{
+		{"leave", func(t *testing.T, room *GameRoom, tokenX string) {
+			expectStatus(t, leave(t, room, tokenX), http.StatusOK)
+		}},
+		{"timeout", func(t *testing.T, room *GameRoom, tokenX string) {
+			room.TurnStartedAt = room.TurnStartedAt.Add(-61 * time.Second)
+			expectStatus(t, move(t, room, tokenX, 4), http.StatusBadRequest)
+		}},
+	}
+	tests := []struct {
+		policy string
+		x, o   Scores
+	}{
+		{"loss", Scores{Losses: 1}, Scores{Wins: 1}},
+		{"forfeit", Scores{Forfeits: 1}, Scores{Wins: 1}},
+		{"none", Scores{}, Scores{}},
+	}
+	for _, tt := range tests {
+		for _, f := range forfeits {
+			t.Run(tt.policy+"/"+f.how, func(t *testing.T) {
+				setupServer(t)
+				setVar(t, &forfeitScoring, tt.policy)
+				room, tokenX, _ := startGameFor(t, map[string]interface{}{"total_seconds": 60})
+
+				f.forfeit(t, room, tokenX)
+				if room.ForfeitedBy != "X" {
+					t.Fatalf("forfeited by %q, want X", room.ForfeitedBy)
+				}
+				if room.PlayerX.Scores != tt.x || room.PlayerO.Scores != tt.o {
+					t.Errorf("scores X %+v O %+v, want X %+v O %+v", room.PlayerX.Scores, room.PlayerO.Scores, tt.x, tt.o)
+				}
+			})
+		}
+
+		// Games won on the board score normally under every policy
+		t.Run(tt.policy+"/won", func(t *testing.T) {
+			setupServer(t)
+			setVar(t, &forfeitScoring, tt.policy)
+			room, tokenX, tokenO := startGameFor(t, nil)
+			playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+			if room.PlayerX.Scores != (Scores{Wins: 1}) || room.PlayerO.Scores != (Scores{Losses: 1}) {
+				t.Errorf("scores X %+v O %+v", room.PlayerX.Scores, room.PlayerO.Scores)
+			}
+		})
+	}
+}
+
+func TestMoveWithoutOpponent(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+	room := createGame(t, token, nil)
+	room.Status = "playing"
+
+	rec := move(t, room, token, 4)
+	expectStatus(t, rec, http.StatusConflict)
+	if code := errorCode(t, rec); code != "missing_player" {
+		t.Errorf("error code %q, want missing_player", code)
+	}
+	if room.Board[4] != "" {
+		t.Error("the move was applied")
+	}
+}
+
+// recentGames fetches the recent games feed with the given query
+func recentGames(t *testing.T, query string) []RecentGame {
+	t.Helper()
+	rec := call(t, handleRecentGames, "GET", "/api/games/recent?"+query, "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var feed []RecentGame
+	decode(t, rec, &feed)
+	return feed
+}
+
+func TestRecentGames(t *testing.T) {
+	setupServer(t)
+	x := &User{ID: "x", Username: "alice"}
+	o := &User{ID: "o", Username: "bob"}
+
+	won := newPlayingRoom(3, x, o)
+	playMoves(t, won, 0, 3, 1, 4, 2)
+	drawn := newPlayingRoom(3, x, o)
+	playMoves(t, drawn, 0, 1, 2, 4, 3, 5, 7, 6, 8)
+	practice := newPlayingRoom(3, x, o)
+	practice.Mode = "practice"
+	playMoves(t, practice, 0, 3, 1, 4, 2)
+
+	feed := recentGames(t, "")
+	if len(feed) != 2 {
+		t.Fatalf("feed has %d games, want 2 (practice is left out)", len(feed))
+	}
+	if feed[0].Code != drawn.Code || feed[0].Winner != "draw" || feed[1].Code != won.Code || feed[1].Winner != "X" {
+		t.Errorf("feed = %+v, want the draw then the win", feed)
+	}
+	if feed[1].PlayerX != "alice" || feed[1].PlayerO != "bob" || feed[1].FinishedAt.IsZero() {
+		t.Errorf("feed entry missing details: %+v", feed[1])
+	}
+
+	if feed := recentGames(t, "limit=1"); len(feed) != 1 || feed[0].Code != drawn.Code {
+		t.Errorf("limit=1 feed = %+v", feed)
+	}
+	for _, limit := range []string{"0", "x", fmt.Sprint(recentGamesCap + 1)} {
+		rec := call(t, handleRecentGames, "GET", "/api/games/recent?limit="+limit, "", nil)
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestRecentGamesCap(t *testing.T) {
+	setupServer(t)
+	x := &User{ID: "x", Username: "alice"}
+	o := &User{ID: "o", Username: "bob"}
+
+	var last *GameRoom
+	for i := 0; i < recentGamesCap+5; i++ {
+		last = newPlayingRoom(3, x, o)
+		finishGame(last, "X")
+	}
+	if len(games.recent) != recentGamesCap {
+		t.Errorf("retained %d games, want %d", len(games.recent), recentGamesCap)
+	}
+	feed := recentGames(t, fmt.Sprintf("limit=%d", recentGamesCap))
+	if len(feed) != recentGamesCap || feed[0].Code != last.Code {
+		t.Errorf("feed has %d games starting with %s, want %d starting with %s", len(feed), feed[0].Code, recentGamesCap, last.Code)
+	}
+}
+
+func TestDeterministicRandReader(t *testing.T) {
+	setupServer(t)
+
+	setVar[io.Reader](t, &randReader, bytes.NewReader([]byte{0, 1, 2, 3, 4, 31, 32}))
+	if code := generateGameCode(); code != "ABCDE9" {
+		t.Errorf("code = %q, want ABCDE9", code)
+	}
+
+	seq := make([]byte, 48)
+	for i := range seq {
+		seq[i] = byte(i)
+	}
+	randReader = bytes.NewReader(seq)
+	if id := generateID(); id != "000102030405060708090a0b0c0d0e0f" {
+		t.Errorf("ID = %q", id)
+	}
+	if token := generateToken(); token != hex.EncodeToString(seq[16:]) {
+		t.Errorf("token = %q", token)
+	}
+
+	// A code already in use is drawn again
+	games.codes["AAAAAA"] = "taken"
+	randReader = bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 1})
+	if code := uniqueGameCode(); code != "BBBBBB" {
+		t.Errorf("unique code = %q, want BBBBBB", code)
+	}
+
+	// Handlers get reproducible IDs and codes too
+	delete(games.codes, "AAAAAA")
+	token := register(t, "alice")
+	randReader = bytes.NewReader(make([]byte, 1024))
+	room := createGame(t, token, nil)
+	if room.ID != strings.Repeat("0", 32) || room.Code != "AAAAAA" {
+		t.Errorf("room ID %q, code %q", room.ID, room.Code)
+	}
+}
+
+// transferHost gives up hosting room
+func transferHost(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleTransferHost, "POST", "/api/game/transfer-host", token, map[string]string{"room_id": room.ID})
+}
+
+func TestTransferHost(t *testing.T) {
+	setupServer(t)
+	alice := register(t, "alice")
+	bob := register(t, "bob")
+	carol := register(t, "carol")
+	room := createGame(t, alice, nil)
+	code := room.Code
+
+	expectStatus(t, transferHost(t, room, bob), http.StatusForbidden)
+	expectStatus(t, transferHost(t, room, alice), http.StatusOK)
+	if room.PlayerX != nil || room.Status != "waiting" || games.codes[code] != room.ID {
+		t.Fatalf("after transfer: host %v, status %s, code kept %v", room.PlayerX, room.Status, games.codes[code] == room.ID)
+	}
+
+	// The next joiner hosts, and the one after plays them
+	joinGame(t, bob, code)
+	if room.PlayerX == nil || room.PlayerX.Username != "bob" || room.Status != "waiting" {
+		t.Fatalf("after bob joined: host %v, status %s", room.PlayerX, room.Status)
+	}
+	joinGame(t, carol, code)
+	if room.PlayerO == nil || room.PlayerO.Username != "carol" || room.Status != "playing" {
+		t.Fatalf("after carol joined: O %v, status %s", room.PlayerO, room.Status)
+	}
+
+	expectStatus(t, transferHost(t, room, bob), http.StatusConflict)
+}
+
+// undo takes back the last move in room
+func undo(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleUndoMove, "POST", "/api/game/undo", token, map[string]string{"room_id": room.ID})
+}
+
+func TestPracticeUndo(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"mode": "practice"})
+
+	expectStatus(t, undo(t, room, tokenX), http.StatusBadRequest)
+
+	// O takes back X's move without asking
+	playTurns(t, room, tokenX, tokenO, 4)
+	expectStatus(t, undo(t, room, tokenO), http.StatusOK)
+	if room.Board[4] != "" || room.CurrentTurn != "X" || len(room.Moves) != 0 || room.LastMove != -1 {
+		t.Errorf("after undo: board %q, turn %s, moves %v, last %d", room.Board, room.CurrentTurn, room.Moves, room.LastMove)
+	}
+
+	// Finishing scores nothing, and undoing reopens the game
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+	if room.Status != "finished" || room.PlayerX.Scores != (Scores{}) || room.PlayerO.Scores != (Scores{}) {
+		t.Fatalf("status %s, scores %+v and %+v", room.Status, room.PlayerX.Scores, room.PlayerO.Scores)
+	}
+	if saved := savedUser(t, "alice"); saved.Scores != (Scores{}) {
+		t.Errorf("practice win saved: %+v", saved.Scores)
+	}
+	for _, user := range leaderboard(t, "") {
+		if user.Scores != (Scores{}) {
+			t.Errorf("practice result on the leaderboard: %s %+v", user.Username, user.Scores)
+		}
+	}
+	expectStatus(t, undo(t, room, tokenX), http.StatusOK)
+	if room.Status != "playing" || room.Winner != "" || room.WinningLine != nil || room.CurrentTurn != "X" || room.LastMove != 4 {
+		t.Errorf("after undoing the win: status %s, winner %q, turn %s, last %d", room.Status, room.Winner, room.CurrentTurn, room.LastMove)
+	}
+
+	// Only the players can undo
+	expectStatus(t, undo(t, room, register(t, "carol")), http.StatusForbidden)
+}
+
+func TestUndoOnlyInPractice(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	playTurns(t, room, tokenX, tokenO, 4)
+
+	rec := undo(t, room, tokenX)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if code := errorCode(t, rec); code != "undo_not_allowed" {
+		t.Errorf("error code %q, want undo_not_allowed", code)
+	}
+	if room.Board[4] != "X" {
+		t.Error("the move was undone")
+	}
+}
+
+func TestUndoDropsLaterSkips(t *testing.T) {
+	setupServer(t)
+	room := newPlayingRoom(3, &User{ID: "x"}, &User{ID: "o"})
+	room.Mode = "practice"
+
+	// X moves, O's turn is skipped, and X moves again
+	playMoves(t, room, 0)
+	room.SkippedTurns = []TurnSkip{{Symbol: "O", AfterMove: 1}}
+	room.CurrentTurn = "X"
+	playMoves(t, room, 4)
+
+	undoMove(room)
+	if len(room.SkippedTurns) != 1 || room.CurrentTurn != "X" {
+		t.Errorf("after one undo: skips %v, turn %s", room.SkippedTurns, room.CurrentTurn)
+	}
+	undoMove(room)
+	if len(room.SkippedTurns) != 0 || room.CurrentTurn != "X" {
+		t.Errorf("after two undos: skips %v, turn %s", room.SkippedTurns, room.CurrentTurn)
+	}
+	if err := validateRoom(room); err != nil {
+		t.Errorf("undo left an impossible room: %v", err)
+	}
+}
+
+func TestDecodeErrorMessages(t *testing.T) {
+	setupServer(t)
+	token := register(t, "alice")
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"", "Empty request body"},
+		{`{"room_id":`, "Malformed JSON: unexpected end of body"},
+		{`{"room_id" "abc"}`, "Malformed JSON at byte 12"},
+		{`{"room_id":"abc","index":"4"}`, "Field 'index' must be a number"},
+		{`{"room_id":7}`, "Field 'room_id' must be a string"},
+		{`[4]`, "Request body must be an object"},
+	}
+	for _, tt := range tests {
+		rec := call(t, handleGameMove, "POST", "/api/game/move", token, tt.body)
+		expectStatus(t, rec, http.StatusBadRequest)
+		var resp struct {
+			Error string `json:"error"`
+		}
+		decode(t, rec, &resp)
+		if resp.Error != tt.want {
+			t.Errorf("%q: error %q, want %q", tt.body, resp.Error, tt.want)
+		}
+	}
+}
+
+// registerError attempts to register username, expecting it to fail with
+// status, and returns the error body
+func registerError(t *testing.T, username string, status int) map[string]string {
+	t.Helper()
+	rec := call(t, handleRegister, "POST", "/api/register", "", map[string]string{"username": username})
+	expectStatus(t, rec, status)
+	var resp map[string]string
+	decode(t, rec, &resp)
+	return resp
+}
+
+func TestReservedUsernames(t *testing.T) {
+	setupServer(t)
+	for _, name := range []string{"admin", "ADMIN", "System", "bot", "guest", "Guest-1234", "guestbook"} {
+		resp := registerError(t, name, http.StatusBadRequest)
+		if resp["code"] != "invalid_field" || resp["field"] != "username" {
+			t.Errorf("%s: error %v", name, resp)
+		}
+	}
+	register(t, "admiral")
+	register(t, "robot")
+}
+
+func TestUsernameLengthLimits(t *testing.T) {
+	setupServer(t)
+	setVar(t, &usernameMin, 4)
+	setVar(t, &usernameMax, 6)
+
+	for _, name := range []string{"abc", "abcdefg", "ab"} {
+		resp := registerError(t, name, http.StatusBadRequest)
+		if resp["code"] != "invalid_field" || resp["field"] != "username" || resp["error"] != "username must be 4 to 6 characters" {
+			t.Errorf("%s: error %v", name, resp)
+		}
+	}
+	register(t, "abcd")
+	register(t, "éèêëàâ") // six characters, twelve bytes
+
+	resp := registerError(t, "abcd", http.StatusConflict)
+	if resp["code"] != "username_taken" || resp["field"] != "username" {
+		t.Errorf("taken: error %v", resp)
+	}
+}
+
+func TestSessionCapEvictsLeastRecentlyUsed(t *testing.T) {
+	setupServer(t)
+	sessions.max = 3
+
+	alice := register(t, "alice")
+	bob := register(t, "bob")
+	carol := register(t, "carol")
+
+	// Using alice's session makes bob's the least recently used
+	if _, ok := sessions.lookup(alice); !ok {
+		t.Fatal("alice's session missing")
+	}
+	dave := register(t, "dave")
+
+	if _, ok := sessions.lookup(bob); ok {
+		t.Error("bob's session survived eviction")
+	}
+	for name, token := range map[string]string{"alice": alice, "carol": carol, "dave": dave} {
+		if _, ok := sessions.lookup(token); !ok {
+			t.Errorf("%s's session was evicted", name)
+		}
+	}
+	if n := sessions.lru.Len(); n != 3 || len(sessions.sessions) != 3 {
+		t.Errorf("%d sessions in the list and %d in the map, want 3", n, len(sessions.sessions))
+	}
+
+	rec := call(t, handleCurrentGame, "GET", "/api/game/current", bob, nil)
+	expectStatus(t, rec, http.StatusUnauthorized)
+}
+
+func TestDrainGames(t *testing.T) {
+	setupServer(t)
+	playing, tokenX, tokenO := startGameFor(t, nil)
+	waiting := createGame(t, tokenX, nil)
+	finished := createGame(t, tokenO, nil)
+	joinGame(t, tokenX, finished.Code)
+	playTurns(t, finished, tokenO, tokenX, 0, 3, 1, 4, 2)
+
+	drained := make(chan bool)
+	go func() {
+		drainGames(200 * time.Millisecond)
+		close(drained)
+	}()
+	for !getState(t, playing, tokenX).ServerRestarting {
+		time.Sleep(time.Millisecond)
+	}
+
+	if !getState(t, waiting, tokenX).ServerRestarting {
+		t.Error("waiting room not flagged")
+	}
+	if getState(t, finished, tokenX).ServerRestarting {
+		t.Error("finished room flagged")
+	}
+
+	// Moves in flight still land during the grace period, but no new
+	// games start
+	expectStatus(t, move(t, playing, tokenX, 4), http.StatusOK)
+	rec := call(t, handleCreateGame, "POST", "/api/game/create", tokenO, map[string]int{})
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if code := errorCode(t, rec); code != "server_restarting" {
+		t.Errorf("error code %q, want server_restarting", code)
+	}
+
+	select {
+	case <-drained:
+		t.Error("drain finished before the grace period")
+	default:
+	}
+	<-drained
+}
+
+// createWithKey creates a room, sending key as the Idempotency-Key, and
+// returns the ID of the room in the response
+func createWithKey(t *testing.T, token, key string) string {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/game/create", strings.NewReader(`{"board_size":4}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	handleCreateGame(rec, req)
+	expectStatus(t, rec, http.StatusOK)
+
+	var room GameRoom
+	decode(t, rec, &room)
+	return room.ID
+}
+
+func TestCreateIdempotencyKey(t *testing.T) {
+	setupServer(t)
+	alice := register(t, "alice")
+	bob := register(t, "bob")
+
+	first := createWithKey(t, alice, "retry-1")
+	if again := createWithKey(t, alice, "retry-1"); again != first {
+		t.Errorf("retry created room %s, want %s", again, first)
+	}
+	if len(games.rooms) != 1 {
+		t.Fatalf("%d rooms after a retry, want 1", len(games.rooms))
+	}
+
+	// Keys are per user, and a new key or none creates a new room
+	if other := createWithKey(t, bob, "retry-1"); other == first {
+		t.Error("another user's key returned alice's room")
+	}
+	if other := createWithKey(t, alice, "retry-2"); other == first {
+		t.Error("a different key returned the same room")
+	}
+	if other := createWithKey(t, alice, ""); other == first {
+		t.Error("no key returned the keyed room")
+	}
+
+	// Keys expire, and are swept with old rooms
+	key := idempotencyKey{UserID: games.rooms[first].PlayerX.ID, Key: "retry-1"}
+	entry := games.created[key]
+	entry.CreatedAt = entry.CreatedAt.Add(-idempotencyTTL - time.Second)
+	games.created[key] = entry
+	if again := createWithKey(t, alice, "retry-1"); again == first {
+		t.Error("an expired key returned the old room")
+	}
+	sweepOldGames(time.Now().UTC().Add(idempotencyTTL + time.Second))
+	if len(games.created) != 0 {
+		t.Errorf("%d keys left after the sweep", len(games.created))
+	}
+}
+
+func TestMoveErrorsByGameState(t *testing.T) {
+	setupServer(t)
+	alice := register(t, "alice")
+	bob := register(t, "bob")
+
+	// Waiting: the host can't move before anyone joins
+	room := createGame(t, alice, nil)
+	rec := move(t, room, alice, 0)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if code := errorCode(t, rec); code != "waiting_for_opponent" {
+		t.Errorf("waiting: code %q, want waiting_for_opponent", code)
+	}
+
+	// Playing: the other player's move
+	joinGame(t, bob, room.Code)
+	rec = move(t, room, bob, 0)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if code := errorCode(t, rec); code != "not_your_turn" {
+		t.Errorf("playing: code %q, want not_your_turn", code)
+	}
+
+	// Finished: the loser's late move reports the winner
+	playTurns(t, room, alice, bob, 0, 3, 1, 4, 2)
+	rec = move(t, room, bob, 5)
+	expectStatus(t, rec, http.StatusBadRequest)
+	var resp map[string]string
+	decode(t, rec, &resp)
+	if resp["code"] != "game_over" || resp["winner"] != "X" {
+		t.Errorf("finished: error %v, want game_over won by X", resp)
+	}
+
+	// Ready check: nobody moves until both are ready
+	checked := createGame(t, alice, map[string]interface{}{"ready_check": true})
+	joinGame(t, bob, checked.Code)
+	rec = move(t, checked, alice, 0)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if code := errorCode(t, rec); code != "waiting_for_ready" {
+		t.Errorf("ready check: code %q, want waiting_for_ready", code)
+	}
+}
+
+func TestLegalMoves(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"board_size": 7})
+	playTurns(t, room, tokenX, tokenO, 0, 48, 24, 6, 10)
+
+	rec := call(t, handleGameState, "GET", "/api/game/state?legal_moves=1&room_id="+room.ID, tokenX, nil)
+	expectStatus(t, rec, http.StatusOK)
+	var state gameStateResponse
+	decode(t, rec, &state)
+
+	var want []int
+	for i := 0; i < 49; i++ {
+		if i != 0 && i != 48 && i != 24 && i != 6 && i != 10 {
+			want = append(want, i)
+		}
+	}
+	if fmt.Sprint(state.LegalMoves) != fmt.Sprint(want) {
+		t.Errorf("legal moves = %v, want %v", state.LegalMoves, want)
+	}
+
+	// Off by default, and empty once the game is over
+	if getState(t, room, tokenX).LegalMoves != nil {
+		t.Error("legal moves sent without being asked for")
+	}
+	room.Status = "finished"
+	rec = call(t, handleGameState, "GET", "/api/game/state?legal_moves=1&room_id="+room.ID, tokenX, nil)
+	if strings.Contains(rec.Body.String(), "legal_moves") {
+		t.Errorf("finished game lists legal moves: %s", rec.Body)
+	}
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	setupServer(t)
+	register(t, "alice")
+	setVar(t, &registration, "closed")
+
+	resp := registerError(t, "bob", http.StatusForbidden)
+	if resp["code"] != "registration_closed" {
+		t.Errorf("register error %v, want registration_closed", resp)
+	}
+	rec := call(t, handleGuest, "POST", "/api/guest", "", nil)
+	expectStatus(t, rec, http.StatusForbidden)
+	if code := errorCode(t, rec); code != "registration_closed" {
+		t.Errorf("guest error code %q, want registration_closed", code)
+	}
+	if len(db.Users) != 1 {
+		t.Errorf("%d users, want only alice", len(db.Users))
+	}
+
+	// Existing users still log in
+	rec = call(t, handleLogin, "POST", "/api/login", "", map[string]string{"username": "alice"})
+	expectStatus(t, rec, http.StatusOK)
+
+	registration = "open"
+	register(t, "bob")
+	guest(t)
+}
+
+func TestMoveAgainstYourself(t *testing.T) {
+	setupServer(t)
+	room, tokenX, _ := startGameFor(t, nil)
+	room.PlayerO = room.PlayerX
+
+	rec := move(t, room, tokenX, 0)
+	expectStatus(t, rec, http.StatusConflict)
+	if code := errorCode(t, rec); code != "same_player" {
+		t.Errorf("error code %q, want same_player", code)
+	}
+	if room.Board[0] != "" || room.CurrentTurn != "X" {
+		t.Error("a move was applied")
+	}
+}
+
+func TestExportUser(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"board_size": 4})
+	expectStatus(t, setPreferences(t, tokenX, map[string]string{"theme": "dark"}), http.StatusOK)
+	playTurns(t, room, tokenX, tokenO, 0, 4, 1, 5, 2)
+
+	rec := call(t, handleExportUser, "GET", "/api/user/export", tokenX, nil)
+	expectStatus(t, rec, http.StatusOK)
+	if cd := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") {
+		t.Errorf("Content-Disposition = %q, want an attachment", cd)
+	}
+
+	var export struct {
+		ExportedAt  time.Time    `json:"exported_at"`
+		Account     User         `json:"account"`
+		RecentGames []RecentGame `json:"recent_games"`
+	}
+	decode(t, rec, &export)
+	if export.ExportedAt.IsZero() {
+		t.Error("no exported_at")
+	}
+	a := export.Account
+	if a.Username != "alice" || a.Scores.Wins != 1 || a.SizeScores[4] == nil || a.Preferences["theme"] != "dark" {
+		t.Errorf("account = %+v", a)
+	}
+	if len(export.RecentGames) != 1 || export.RecentGames[0].Code != room.Code {
+		t.Errorf("recent games = %+v", export.RecentGames)
+	}
+
+	// Nothing that would let someone act as the user
+	if body := rec.Body.String(); strings.Contains(body, tokenX) || strings.Contains(body, "token") {
+		t.Errorf("export contains a session token: %s", body)
+	}
+
+	expectStatus(t, call(t, handleExportUser, "GET", "/api/user/export", "", nil), http.StatusUnauthorized)
+}
+
+func TestWinPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		board   string
+		want    string
+	}{
+		{"square", "XX.XX....", "X"},
+		{"square", "....OO.OO", "O"},
+		{"square", "X...X...X", "X"}, // a line still wins
+		{"line", "XX.XX....", ""},
+		{"corners", "X.X...X.X", "X"},
+		{"line", "X.X...X.X", ""},
+		{"square", "X.X...X.X", ""},
+	}
+	for _, tt := range tests {
+		got, _ := checkWinner(cells(tt.board), generatePatternConditions(tt.pattern, 3, 3))
+		if got != tt.want {
+			t.Errorf("%s %s: winner %q, want %q", tt.pattern, tt.board, got, tt.want)
+		}
+	}
+}
+
+func TestWinPatternGames(t *testing.T) {
+	t.Run("square", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"win_pattern": "square"})
+		playTurns(t, room, tokenX, tokenO, 0, 2, 1, 6, 3, 8, 4)
+		if room.Winner != "X" || fmt.Sprint(room.WinningLine) != "[0 1 3 4]" {
+			t.Errorf("winner %q, line %v", room.Winner, room.WinningLine)
+		}
+	})
+	t.Run("corners", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"board_size": 4, "win_length": 4, "win_pattern": "corners"})
+		playTurns(t, room, tokenX, tokenO, 0, 1, 3, 2, 12, 5, 15)
+		if room.Winner != "X" || fmt.Sprint(room.WinningLine) != "[0 3 12 15]" {
+			t.Errorf("winner %q, line %v", room.Winner, room.WinningLine)
+		}
+	})
+	t.Run("unknown", func(t *testing.T) {
+		setupServer(t)
+		token := register(t, "alice")
+		rec := call(t, handleCreateGame, "POST", "/api/game/create", token, map[string]string{"win_pattern": "diamond"})
+		expectStatus(t, rec, http.StatusBadRequest)
+	})
+}
+
+// votePauseFor asks to pause (or resume) room for the holder of token
+func votePauseFor(t *testing.T, room *GameRoom, token string, pause bool) *httptest.ResponseRecorder {
+	t.Helper()
+	if pause {
+		return call(t, handlePauseGame, "POST", "/api/game/pause", token, map[string]string{"room_id": room.ID})
+	}
+	return call(t, handleResumeGame, "POST", "/api/game/resume", token, map[string]string{"room_id": room.ID})
+}
+
+func TestPauseNeedsBothPlayers(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+
+	expectStatus(t, votePauseFor(t, room, tokenX, true), http.StatusOK)
+	expectStatus(t, votePauseFor(t, room, tokenX, true), http.StatusOK)
+	if room.Paused || room.PauseRequestBy != "X" {
+		t.Fatalf("paused %v, requested by %q after X asked twice", room.Paused, room.PauseRequestBy)
+	}
+	expectStatus(t, votePauseFor(t, room, tokenO, true), http.StatusOK)
+	if !room.Paused || room.PausedAt.IsZero() {
+		t.Fatal("not paused after both asked")
+	}
+
+	rec := move(t, room, tokenX, 4)
+	expectStatus(t, rec, http.StatusConflict)
+	if code := errorCode(t, rec); code != "game_paused" {
+		t.Errorf("error code %q, want game_paused", code)
+	}
+	rec = votePauseFor(t, room, tokenX, true)
+	expectStatus(t, rec, http.StatusConflict)
+
+	expectStatus(t, votePauseFor(t, room, tokenO, false), http.StatusOK)
+	if !room.Paused {
+		t.Fatal("resumed on one request")
+	}
+	expectStatus(t, votePauseFor(t, room, tokenX, false), http.StatusOK)
+	if room.Paused {
+		t.Fatal("still paused after both asked to resume")
+	}
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+	expectStatus(t, votePauseFor(t, room, tokenO, false), http.StatusConflict)
+	expectStatus(t, votePauseFor(t, room, register(t, "carol"), true), http.StatusForbidden)
+}
+
+func TestPauseStopsTheClock(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"total_seconds": 60})
+
+	// X has thought for 5 seconds when the game is paused
+	room.TurnStartedAt = room.TurnStartedAt.Add(-5 * time.Second)
+	expectStatus(t, votePauseFor(t, room, tokenX, true), http.StatusOK)
+	expectStatus(t, votePauseFor(t, room, tokenO, true), http.StatusOK)
+
+	// A pause longer than X's clock doesn't run it out
+	room.PausedAt = room.PausedAt.Add(-100 * time.Second)
+	room.TurnStartedAt = room.TurnStartedAt.Add(-100 * time.Second)
+	if state := getState(t, room, tokenO); state.Status != "playing" {
+		t.Fatalf("status %s while paused", state.Status)
+	}
+
+	expectStatus(t, votePauseFor(t, room, tokenX, false), http.StatusOK)
+	expectStatus(t, votePauseFor(t, room, tokenO, false), http.StatusOK)
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+	if room.TimeLeftX < 54 || room.TimeLeftX > 55.5 {
+		t.Errorf("X has %.1fs left, want about 55", room.TimeLeftX)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	setupServer(t)
+	register(t, "alice")
+
+	rec := call(t, handleLeaderboard, "GET", "/api/leaderboard", "", nil)
+	if strings.Contains(rec.Body.String(), "\n  ") {
+		t.Errorf("compact response is indented: %s", rec.Body)
+	}
+
+	setVar(t, &prettyJSON, true)
+	rec = call(t, handleLeaderboard, "GET", "/api/leaderboard", "", nil)
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "[\n  {\n    \"id\"") {
+		t.Errorf("pretty response not indented: %s", body)
+	}
+	var users []User
+	decode(t, rec, &users)
+	if len(users) != 1 {
+		t.Errorf("pretty response decodes to %d users", len(users))
+	}
+
+	// Errors are indented too
+	rec = call(t, handleLeaderboard, "GET", "/api/leaderboard?sort=name", "", nil)
+	if !strings.Contains(rec.Body.String(), "{\n  \"error\"") {
+		t.Errorf("pretty error not indented: %s", rec.Body)
+	}
+}
+
+// evaluate asks for an evaluation of indices in room
+func evaluate(t *testing.T, room *GameRoom, indices []int) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleEvaluateMoves, "POST", "/api/game/evaluate", "", map[string]interface{}{"room_id": room.ID, "indices": indices})
+}
+
+func TestEvaluateMoves(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4)
+
+	rec := evaluate(t, room, []int{2, 5, 0, 9, -1, 6})
+	expectStatus(t, rec, http.StatusOK)
+	var resp struct {
+		CurrentTurn string           `json:"current_turn"`
+		Evaluations []moveEvaluation `json:"evaluations"`
+	}
+	decode(t, rec, &resp)
+	want := []moveEvaluation{
+		{Index: 2, Legal: true, Wins: true},
+		{Index: 5, Legal: true, Blocks: true},
+		{Index: 0, Reason: "cell_taken"},
+		{Index: 9, Reason: "invalid_position"},
+		{Index: -1, Reason: "invalid_position"},
+		{Index: 6, Legal: true},
+	}
+	if resp.CurrentTurn != "X" || fmt.Sprint(resp.Evaluations) != fmt.Sprint(want) {
+		t.Errorf("turn %s, evaluations %+v, want %+v", resp.CurrentTurn, resp.Evaluations, want)
+	}
+
+	// Nothing is legal once the game is over
+	playTurns(t, room, tokenX, tokenO, 2)
+	rec = evaluate(t, room, []int{5})
+	expectStatus(t, rec, http.StatusOK)
+	decode(t, rec, &resp)
+	if len(resp.Evaluations) != 1 || resp.Evaluations[0].Legal || resp.Evaluations[0].Reason != "game_over" {
+		t.Errorf("after the game: %+v", resp.Evaluations)
+	}
+}
+
+func TestEvaluateMovesLimits(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"hints_disabled": true})
+
+	expectStatus(t, evaluate(t, room, nil), http.StatusBadRequest)
+	expectStatus(t, evaluate(t, room, make([]int, maxEvaluateCandidates+1)), http.StatusBadRequest)
+	expectStatus(t, evaluate(t, room, make([]int, maxEvaluateCandidates)), http.StatusForbidden)
+
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+	expectStatus(t, evaluate(t, room, []int{5}), http.StatusOK)
+}
+
+// moveAt moves at index, sending expectedVersion as the expected_version
+func moveAt(t *testing.T, room *GameRoom, token string, index, expectedVersion int) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleGameMove, "POST", "/api/game/move", token, map[string]interface{}{"room_id": room.ID, "index": index, "expected_version": expectedVersion})
+}
+
+func TestMoveExpectedVersion(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+
+	version := getState(t, room, tokenX).Version
+	expectStatus(t, moveAt(t, room, tokenX, 4, version), http.StatusOK)
+
+	// O saw the board before X moved
+	rec := moveAt(t, room, tokenO, 4, version)
+	expectStatus(t, rec, http.StatusConflict)
+	var resp struct {
+		Code  string            `json:"code"`
+		State gameStateResponse `json:"state"`
+	}
+	decode(t, rec, &resp)
+	if resp.Code != "stale_state" {
+		t.Errorf("error code %q, want stale_state", resp.Code)
+	}
+	if resp.State.GameRoom == nil || resp.State.Version != room.Version || resp.State.Board[4] != "X" || !resp.State.YourTurn {
+		t.Errorf("stale response state = %+v", resp.State.GameRoom)
+	}
+	if room.Board[4] != "X" || room.CurrentTurn != "O" {
+		t.Error("the stale move changed the room")
+	}
+
+	// Resynced, O's move goes through; without a version it isn't checked
+	expectStatus(t, moveAt(t, room, tokenO, 0, resp.State.Version), http.StatusOK)
+	expectStatus(t, move(t, room, tokenX, 8), http.StatusOK)
+}
+
+// ready confirms the holder of token is ready to play in room
+func ready(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleGameReady, "POST", "/api/game/ready", token, map[string]string{"room_id": room.ID})
+}
+
+func TestReadyCheckStartsGame(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"ready_check": true})
+	if room.Status != "ready_check" || room.ReadyDeadline.IsZero() {
+		t.Fatalf("status %s, deadline %v after joining", room.Status, room.ReadyDeadline)
+	}
+
+	expectStatus(t, ready(t, room, tokenO), http.StatusOK)
+	expectStatus(t, ready(t, room, tokenO), http.StatusOK)
+	if room.Status != "ready_check" || !room.ReadyO || room.ReadyX {
+		t.Fatalf("status %s, ready X %v O %v after O confirmed", room.Status, room.ReadyX, room.ReadyO)
+	}
+	expectStatus(t, ready(t, room, register(t, "carol")), http.StatusForbidden)
+
+	expectStatus(t, ready(t, room, tokenX), http.StatusOK)
+	if room.Status != "playing" || room.CurrentTurn != "X" {
+		t.Fatalf("status %s, turn %s after both confirmed", room.Status, room.CurrentTurn)
+	}
+	expectStatus(t, move(t, room, tokenX, 4), http.StatusOK)
+
+	rec := ready(t, room, tokenO)
+	expectStatus(t, rec, http.StatusConflict)
+	if code := errorCode(t, rec); code != "no_ready_check" {
+		t.Errorf("error code %q, want no_ready_check", code)
+	}
+}
+
+func TestReadyCheckTimeout(t *testing.T) {
+	t.Run("on ready", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, _ := startGameFor(t, map[string]interface{}{"ready_check": true})
+		room.ReadyDeadline = time.Now().UTC().Add(-time.Second)
+
+		expectStatus(t, ready(t, room, tokenX), http.StatusConflict)
+		if room.Status != "cancelled" {
+			t.Errorf("status %s, want cancelled", room.Status)
+		}
+	})
+	t.Run("on sweep", func(t *testing.T) {
+		setupServer(t)
+		room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"ready_check": true})
+		expectStatus(t, ready(t, room, tokenX), http.StatusOK)
+		room.ReadyDeadline = time.Now().UTC().Add(-time.Second)
+
+		sweepOldGames(time.Now().UTC())
+		if room.Status != "cancelled" || room.PlayerX.Scores != (Scores{}) || room.PlayerO.Scores != (Scores{}) {
+			t.Errorf("status %s, scores %+v and %+v", room.Status, room.PlayerX.Scores, room.PlayerO.Scores)
+		}
+		if getState(t, room, tokenO).Status != "cancelled" {
+			t.Error("cancelled room not visible to the players")
+		}
+	})
+}
+
+func TestUnknownAPIRoute(t *testing.T) {
+	setupServer(t)
+	chdirSite(t)
+
+	// The same fallbacks as main, beside one real endpoint
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/leaderboard", corsMiddleware(handleLeaderboard))
+	mux.HandleFunc("/api/", corsMiddleware(handleUnknownAPI))
+	mux.Handle("/", staticHandler(http.FileServer(http.Dir("."))))
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	for _, path := range []string{"/api/does-not-exist", "/api/", "/api/leaderboard/extra"} {
+		rec := get(path)
+		if rec.Code != http.StatusNotFound || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+			t.Errorf("%s: status %d, content type %q", path, rec.Code, rec.Header().Get("Content-Type"))
+			continue
+		}
+		if code := errorCode(t, rec); code != "unknown_endpoint" {
+			t.Errorf("%s: error code %q, want unknown_endpoint", path, code)
+		}
+	}
+
+	expectStatus(t, get("/api/leaderboard"), http.StatusOK)
+	if rec := get("/"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<html>") {
+		t.Errorf("/: status %d, body %q", rec.Code, rec.Body)
+	}
+	// FileServer sends /index.html to the directory
+	if rec := get("/index.html"); rec.Code != http.StatusMovedPermanently {
+		t.Errorf("/index.html: status %d", rec.Code)
+	}
+	if rec := get("/missing.html"); rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "unknown_endpoint") {
+		t.Errorf("/missing.html: status %d, body %q", rec.Code, rec.Body)
+	}
+}
+
+func TestMoveTimeStats(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+
+	// X thinks for 2s and 6s, O for 4s and 1s
+	for _, think := range []struct {
+		token   string
+		index   int
+		seconds int
+	}{
+		{tokenX, 0, 2}, {tokenO, 3, 4}, {tokenX, 1, 6}, {tokenO, 4, 1},
+	} {
+		room.TurnStartedAt = time.Now().UTC().Add(-time.Duration(think.seconds) * time.Second)
+		expectStatus(t, move(t, room, think.token, think.index), http.StatusOK)
+	}
+
+	for _, tt := range []struct {
+		user *User
+		avg  float64
+	}{{room.PlayerX, 4}, {room.PlayerO, 2.5}} {
+		if tt.user.TimedMoves != 2 || math.Abs(tt.user.AvgMoveSeconds-tt.avg) > 0.1 {
+			t.Errorf("%s: %d moves averaging %.2fs, want 2 averaging %.1fs", tt.user.Username, tt.user.TimedMoves, tt.user.AvgMoveSeconds, tt.avg)
+		}
+	}
+
+	// Saved with the result
+	room.TurnStartedAt = time.Now().UTC()
+	expectStatus(t, move(t, room, tokenX, 2), http.StatusOK)
+	if saved := savedUser(t, "alice"); saved.TimedMoves != 3 || saved.MoveSeconds < 8 {
+		t.Errorf("saved %d moves over %.1fs", saved.TimedMoves, saved.MoveSeconds)
+	}
+}
+
+func TestSpeedLeaderboard(t *testing.T) {
+	setupServer(t)
+	for _, player := range []struct {
+		name    string
+		moves   int
+		seconds float64
+	}{
+		{"slow", speedMinMoves, 3},
+		{"quick", speedMinMoves + 5, 1},
+		{"newbie", speedMinMoves - 1, 0.5},
+	} {
+		register(t, player.name)
+		user := findUserByUsername(player.name)
+		for i := 0; i < player.moves; i++ {
+			addMoveTime(user, player.seconds)
+		}
+	}
+
+	users := leaderboard(t, "sort=speed")
+	if len(users) != 2 || users[0].Username != "quick" || users[1].Username != "slow" {
+		t.Fatalf("speed leaderboard = %+v", users)
+	}
+	if users[0].AvgMoveSeconds != 1 || users[1].AvgMoveSeconds != 3 {
+		t.Errorf("averages %.1f and %.1f, want 1 and 3", users[0].AvgMoveSeconds, users[1].AvgMoveSeconds)
+	}
+
+	rec := call(t, handleLeaderboard, "GET", "/api/leaderboard?sort=slowest", "", nil)
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestSpeedLeaderboardDuringPlay(t *testing.T) {
+	setupServer(t)
+	tokenX := register(t, "alice")
+	tokenO := register(t, "bob")
+
+	// Four wins for X give alice enough timed moves to be ranked
+	var rooms []*GameRoom
+	for i := 0; i < 4; i++ {
+		room := createGame(t, tokenX, nil)
+		joinGame(t, tokenO, room.Code)
+		rooms = append(rooms, room)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, room := range rooms {
+			for i, index := range []int{0, 3, 1, 4, 2} {
+				token := tokenX
+				if i%2 == 1 {
+					token = tokenO
+				}
+				if rec := move(t, room, token, index); rec.Code != http.StatusOK {
+					t.Errorf("move %d: status %d, body %s", index, rec.Code, rec.Body)
+					return
+				}
+			}
+		}
+	}()
+
+	// Run with -race: reading the leaderboard must not race with the
+	// move times and scores each move writes
+	for polling := true; polling; {
+		select {
+		case <-done:
+			polling = false
+		default:
+		}
+		for _, query := range []string{"sort=speed", "board_size=3"} {
+			rec := call(t, handleLeaderboard, "GET", "/api/leaderboard?"+query, "", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: status %d", query, rec.Code)
+			}
+		}
+	}
+
+	users := leaderboard(t, "sort=speed")
+	if len(users) != 1 || users[0].Username != "alice" || users[0].TimedMoves != 12 {
+		t.Errorf("speed leaderboard = %+v, want alice with 12 moves", users)
+	}
+}
+
+// clearEmote dismisses the emote showing in room
+func clearEmote(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleClearEmote, "POST", "/api/game/emote-clear", token, map[string]string{"room_id": room.ID})
+}
+
+func TestClearEmote(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+	expectStatus(t, sendEmote(t, room, tokenX, emotes[0].Type), http.StatusOK)
+
+	rec := clearEmote(t, room, tokenO)
+	expectStatus(t, rec, http.StatusForbidden)
+	if code := errorCode(t, rec); code != "not_your_emote" {
+		t.Errorf("error code %q, want not_your_emote", code)
+	}
+	if !room.ShowEmote {
+		t.Fatal("the opponent cleared the emote")
+	}
+
+	version := room.Version
+	rec = clearEmote(t, room, tokenX)
+	expectStatus(t, rec, http.StatusOK)
+	if room.ShowEmote || room.EmoteType != "" || room.EmoteBy != "" {
+		t.Errorf("emote still showing: %v %q by %q", room.ShowEmote, room.EmoteType, room.EmoteBy)
+	}
+	if room.Version == version {
+		t.Error("clearing didn't update the room")
+	}
+
+	// With nothing showing, clearing is a no-op for either player
+	version = room.Version
+	expectStatus(t, clearEmote(t, room, tokenO), http.StatusOK)
+	if room.Version != version {
+		t.Error("clearing nothing updated the room")
+	}
+	expectStatus(t, clearEmote(t, room, register(t, "carol")), http.StatusForbidden)
+}
+
+// analysis fetches the move annotations of room
+func analysis(t *testing.T, room *GameRoom, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return call(t, handleGameAnalysis, "GET", "/api/game/analysis?room_id="+room.ID, token, nil)
+}
+
+func TestGameAnalysis(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, nil)
+
+	// O's edge reply to the center loses by force
+	playTurns(t, room, tokenX, tokenO, 4, 1)
+	expectStatus(t, analysis(t, room, tokenX), http.StatusConflict)
+	playTurns(t, room, tokenX, tokenO, 0, 8, 6, 2, 3)
+	if room.Winner != "X" {
+		t.Fatalf("winner %q, want X", room.Winner)
+	}
+
+	rec := analysis(t, room, tokenX)
+	expectStatus(t, rec, http.StatusOK)
+	var resp struct {
+		Moves []moveAnnotation `json:"moves"`
+	}
+	decode(t, rec, &resp)
+	if len(resp.Moves) != 7 {
+		t.Fatalf("%d annotations, want 7", len(resp.Moves))
+	}
+
+	outcomes := []string{"draw", "loss", "win", "loss", "win", "loss", "win"}
+	for i, note := range resp.Moves {
+		if note.Ply != i+1 || note.Index != room.Moves[i] || note.Symbol != room.Board[note.Index] {
+			t.Errorf("ply %d: annotation %+v doesn't match the game", i+1, note)
+		}
+		if note.Outcome != outcomes[i] {
+			t.Errorf("ply %d: outcome %s, want %s", i+1, note.Outcome, outcomes[i])
+		}
+		if want := i == 1; note.Blunder != want {
+			t.Errorf("ply %d: blunder %v, want %v (%+v)", i+1, note.Blunder, want, note)
+		}
+	}
+	if note := resp.Moves[1]; note.BestOutcome != "draw" || note.BestIndex%2 != 0 {
+		t.Errorf("O's best reply %d leads to %s, want a corner holding the draw", note.BestIndex, note.BestOutcome)
+	}
+}
+
+func TestGameAnalysisLimits(t *testing.T) {
+	setupServer(t)
+	hintLimiter.limit = 2
+	room, tokenX, tokenO := startGameFor(t, nil)
+	playTurns(t, room, tokenX, tokenO, 0, 3, 1, 4, 2)
+
+	expectStatus(t, analysis(t, room, ""), http.StatusUnauthorized)
+	for i := 0; i < 2; i++ {
+		expectStatus(t, analysis(t, room, tokenX), http.StatusOK)
+	}
+	rec := analysis(t, room, tokenX)
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("rate limited analysis has no Retry-After")
+	}
+	expectStatus(t, analysis(t, room, tokenO), http.StatusOK)
+}
+
+func TestGameAnalysisLargeBoard(t *testing.T) {
+	setupServer(t)
+	room, tokenX, tokenO := startGameFor(t, map[string]interface{}{"board_size": 7})
+	playTurns(t, room, tokenX, tokenO, 0, 7, 1, 8, 2, 9, 3)
+
+	start := time.Now()
+	rec := analysis(t, room, tokenX)
+	expectStatus(t, rec, http.StatusOK)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("analysis took %v", elapsed)
+	}
+	var resp struct {
+		Moves []moveAnnotation `json:"moves"`
+	}
+	decode(t, rec, &resp)
+	if len(resp.Moves) != 7 || resp.Moves[0].Outcome != "unclear" {
+		t.Errorf("annotations = %+v, want the opening unclear", resp.Moves)
+	}
+}
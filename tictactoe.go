@@ -2,13 +2,14 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
 )
 
-type Board [3][3]string
+type Board [][]string
 
 const (
 	Empty  = " "
@@ -16,19 +17,44 @@ const (
 	PlayerO = "O"
 )
 
+var (
+	boardSize = 3 // rows and columns on the board
+	winLength = 3 // marks in a row needed to win
+	bestOf    = 1 // games in a match series
+	
+	stdin = bufio.NewReader(os.Stdin)
+)
+
 func main() {
+	flag.IntVar(&boardSize, "size", boardSize, "board size (3-9)")
+	flag.IntVar(&winLength, "win", winLength, "marks in a row needed to win (3 up to the board size)")
+	flag.IntVar(&bestOf, "best-of", bestOf, "play a series until one player wins a majority of this many games")
+	flag.Parse()
+
+	if boardSize < 3 || boardSize > 9 {
+		fmt.Println("Board size must be between 3 and 9.")
+		os.Exit(2)
+	}
+	if winLength < 3 || winLength > boardSize {
+		fmt.Printf("Win length must be between 3 and %d.\n", boardSize)
+		os.Exit(2)
+	}
+	if bestOf < 1 {
+		fmt.Println("Best-of must be at least 1.")
+		os.Exit(2)
+	}
+
 	fmt.Println("Welcome to Tic Tac Toe!")
 	fmt.Println("======================")
 	
 	for {
-		playGame()
-		
-		fmt.Print("\nPlay again? (y/n): ")
-		reader := bufio.NewReader(os.Stdin)
-		input, _ := reader.ReadString('\n')
-		input = strings.TrimSpace(strings.ToLower(input))
+		if bestOf > 1 {
+			playSeries()
+		} else {
+			playGame()
+		}
 		
-		if input != "y" && input != "yes" {
+		if !askYesNo("\nPlay again? (y/n): ") {
 			fmt.Println("Thanks for playing!")
 			break
 		}
@@ -36,7 +62,61 @@ func main() {
 	}
 }
 
-func playGame() {
+// askYesNo prints prompt and reports whether the player answered yes
+func askYesNo(prompt string) bool {
+	fmt.Print(prompt)
+	input := readLine()
+	input = strings.ToLower(input)
+	return input == "y" || input == "yes"
+}
+
+// readLine reads a trimmed line of input, exiting when input runs out
+func readLine() string {
+	input, err := stdin.ReadString('\n')
+	if err != nil && input == "" {
+		fmt.Println("\nThanks for playing!")
+		os.Exit(0)
+	}
+	return strings.TrimSpace(input)
+}
+
+// playSeries plays games until one player has won a majority of bestOf,
+// or the players stop early. Draws don't count toward either side.
+func playSeries() {
+	needed := bestOf/2 + 1
+	wins := map[string]int{}
+	draws := 0
+	
+	for game := 1; ; game++ {
+		fmt.Printf("\n=== Game %d (best of %d) ===\n", game, bestOf)
+		if winner := playGame(); winner != "" {
+			wins[winner]++
+		} else {
+			draws++
+		}
+		
+		fmt.Printf("\nSeries score: X %d - %d O", wins[PlayerX], wins[PlayerO])
+		if draws > 0 {
+			fmt.Printf(" (%d drawn)", draws)
+		}
+		fmt.Println()
+		
+		for _, player := range []string{PlayerX, PlayerO} {
+			if wins[player] >= needed {
+				fmt.Printf("\n🏆 Player %s wins the series!\n", player)
+				return
+			}
+		}
+		
+		if !askYesNo("\nContinue the series? (y/n): ") {
+			fmt.Println("Series ended early.")
+			return
+		}
+	}
+}
+
+// playGame plays a single game and returns the winning player, or "" for a draw
+func playGame() string {
 	board := initBoard()
 	currentPlayer := PlayerX
 	moveCount := 0
@@ -49,16 +129,16 @@ func playGame() {
 		board[row][col] = currentPlayer
 		moveCount++
 		
-		if checkWinner(board, currentPlayer) {
-			printBoard(board)
+		if line := checkWinner(board, currentPlayer, winLength); line != nil {
+			printWinningBoard(board, line)
 			fmt.Printf("\n🎉 Player %s wins!\n", currentPlayer)
-			break
+			return currentPlayer
 		}
 		
-		if moveCount == 9 {
+		if moveCount == boardSize*boardSize {
 			printBoard(board)
 			fmt.Println("\n🤝 It's a draw!")
-			break
+			return ""
 		}
 		
 		if currentPlayer == PlayerX {
@@ -70,9 +150,10 @@ func playGame() {
 }
 
 func initBoard() Board {
-	var board Board
-	for i := 0; i < 3; i++ {
-		for j := 0; j < 3; j++ {
+	board := make(Board, boardSize)
+	for i := range board {
+		board[i] = make([]string, boardSize)
+		for j := range board[i] {
 			board[i][j] = Empty
 		}
 	}
@@ -80,21 +161,55 @@ func initBoard() Board {
 }
 
 func printBoard(board Board) {
-	fmt.Println("\n     1   2   3")
-	fmt.Println("   +---+---+---+")
-	for i := 0; i < 3; i++ {
-		fmt.Printf(" %d | %s | %s | %s |\n", i+1, board[i][0], board[i][1], board[i][2])
-		fmt.Println("   +---+---+---+")
+	fmt.Print(renderBoard(board, nil))
+}
+
+// printWinningBoard prints the board with the winning cells bracketed
+func printWinningBoard(board Board, line [][2]int) {
+	fmt.Print(renderBoard(board, line))
+}
+
+// renderBoard draws the board, marking any cells in highlight as [X]
+func renderBoard(board Board, highlight [][2]int) string {
+	size := len(board)
+	separator := "   +" + strings.Repeat("---+", size) + "\n"
+
+	header := "   "
+	for j := 0; j < size; j++ {
+		header += fmt.Sprintf("  %d ", j+1)
 	}
+
+	var sb strings.Builder
+	sb.WriteString("\n" + strings.TrimRight(header, " ") + "\n")
+	sb.WriteString(separator)
+	for i := 0; i < size; i++ {
+		sb.WriteString(fmt.Sprintf(" %d |", i+1))
+		for j := 0; j < size; j++ {
+			if isHighlighted(highlight, i, j) {
+				sb.WriteString(fmt.Sprintf("[%s]|", board[i][j]))
+			} else {
+				sb.WriteString(fmt.Sprintf(" %s |", board[i][j]))
+			}
+		}
+		sb.WriteString("\n")
+		sb.WriteString(separator)
+	}
+	return sb.String()
+}
+
+func isHighlighted(cells [][2]int, row, col int) bool {
+	for _, cell := range cells {
+		if cell[0] == row && cell[1] == col {
+			return true
+		}
+	}
+	return false
 }
 
 func getMove(board Board) (int, int) {
-	reader := bufio.NewReader(os.Stdin)
-	
 	for {
 		fmt.Print("Enter your move (row col, e.g., '1 2'): ")
-		input, _ := reader.ReadString('\n')
-		input = strings.TrimSpace(input)
+		input := readLine()
 		
 		parts := strings.Fields(input)
 		if len(parts) != 2 {
@@ -113,8 +228,8 @@ func getMove(board Board) (int, int) {
 		row--
 		col--
 		
-		if row < 0 || row > 2 || col < 0 || col > 2 {
-			fmt.Println("Invalid position. Row and column must be between 1 and 3.")
+		if row < 0 || row >= len(board) || col < 0 || col >= len(board) {
+			fmt.Printf("Invalid position. Row and column must be between 1 and %d.\n", len(board))
 			continue
 		}
 		
@@ -127,28 +242,28 @@ func getMove(board Board) (int, int) {
 	}
 }
 
-func checkWinner(board Board, player string) bool {
-	// Check rows
-	for i := 0; i < 3; i++ {
-		if board[i][0] == player && board[i][1] == player && board[i][2] == player {
-			return true
-		}
-	}
+// checkWinner returns the winning cells for player, or nil if they haven't
+// got winLen marks in a row horizontally, vertically, or diagonally
+func checkWinner(board Board, player string, winLen int) [][2]int {
+	size := len(board)
+	directions := [][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
 	
-	// Check columns
-	for j := 0; j < 3; j++ {
-		if board[0][j] == player && board[1][j] == player && board[2][j] == player {
-			return true
+	for row := 0; row < size; row++ {
+		for col := 0; col < size; col++ {
+			for _, dir := range directions {
+				line := make([][2]int, 0, winLen)
+				r, c := row, col
+				for len(line) < winLen && r >= 0 && r < size && c >= 0 && c < size && board[r][c] == player {
+					line = append(line, [2]int{r, c})
+					r += dir[0]
+					c += dir[1]
+				}
+				if len(line) == winLen {
+					return line
+				}
+			}
 		}
 	}
 	
-	// Check diagonals
-	if board[0][0] == player && board[1][1] == player && board[2][2] == player {
-		return true
-	}
-	if board[0][2] == player && board[1][1] == player && board[2][0] == player {
-		return true
-	}
-	
-	return false
+	return nil
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The CLI and the server are both package main, so run these with
+//
+//	go test tictactoe.go tictactoe_test.go
+
+// boardFrom builds a board from rows of cells, "." for empty
+func boardFrom(rows ...string) Board {
+	board := make(Board, len(rows))
+	for i, row := range rows {
+		board[i] = make([]string, len(row))
+		for j, cell := range row {
+			board[i][j] = string(cell)
+			if cell == '.' {
+				board[i][j] = Empty
+			}
+		}
+	}
+	return board
+}
+
+func TestRenderBoardMarksWinningLine(t *testing.T) {
+	board := boardFrom(
+		"XXX",
+		"OO.",
+		"...",
+	)
+
+	line := checkWinner(board, PlayerX, 3)
+	if line == nil {
+		t.Fatal("checkWinner found no winning line")
+	}
+
+	rows := strings.Split(renderBoard(board, line), "\n")
+	if got, want := rows[3], " 1 |[X]|[X]|[X]|"; got != want {
+		t.Errorf("winning row = %q, want %q", got, want)
+	}
+	if got, want := rows[5], " 2 | O | O |   |"; got != want {
+		t.Errorf("other row = %q, want %q", got, want)
+	}
+}
+
+func TestRenderBoardMidGame(t *testing.T) {
+	board := boardFrom(
+		"X..",
+		".O.",
+		"...",
+	)
+
+	if rendered := renderBoard(board, nil); strings.ContainsAny(rendered, "[]") {
+		t.Errorf("board without a winning line has marked cells:\n%s", rendered)
+	}
+}
+
+func TestCheckWinnerFourInARowOn5x5(t *testing.T) {
+	tests := []struct {
+		name  string
+		board Board
+		want  [][2]int // nil for no win
+	}{
+		{"row", boardFrom(
+			".....",
+			".XXXX",
+			".....",
+			".....",
+			".....",
+		), [][2]int{{1, 1}, {1, 2}, {1, 3}, {1, 4}}},
+		{"column", boardFrom(
+			"X....",
+			"X....",
+			"X....",
+			"X....",
+			".....",
+		), [][2]int{{0, 0}, {1, 0}, {2, 0}, {3, 0}}},
+		{"diagonal", boardFrom(
+			".....",
+			".X...",
+			"..X..",
+			"...X.",
+			"....X",
+		), [][2]int{{1, 1}, {2, 2}, {3, 3}, {4, 4}}},
+		{"anti-diagonal", boardFrom(
+			"....X",
+			"...X.",
+			"..X..",
+			".X...",
+			".....",
+		), [][2]int{{0, 4}, {1, 3}, {2, 2}, {3, 1}}},
+		{"three is not enough", boardFrom(
+			"XXX..",
+			"X....",
+			"X....",
+			".....",
+			"..X..",
+		), nil},
+		{"broken line", boardFrom(
+			"XX.XX",
+			".....",
+			".....",
+			".....",
+			".....",
+		), nil},
+		{"no wrap around", boardFrom(
+			"...XX",
+			"XX...",
+			".....",
+			".....",
+			".....",
+		), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkWinner(tt.board, PlayerX, 4)
+			if len(got) != len(tt.want) {
+				t.Fatalf("checkWinner = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("checkWinner = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// runScripted runs f with input as stdin and returns what it printed
+func runScripted(t *testing.T, input string, f func()) string {
+	t.Helper()
+
+	oldStdin, oldStdout := stdin, os.Stdout
+	defer func() { stdin, os.Stdout = oldStdin, oldStdout }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+
+	stdin = bufio.NewReader(strings.NewReader(input))
+	os.Stdout = w
+	f()
+	w.Close()
+	return <-output
+}
+
+// xWinsTopRow is input for a game X wins along the top row
+const xWinsTopRow = "1 1\n2 1\n1 2\n2 2\n1 3\n"
+
+func TestBestOfThree(t *testing.T) {
+	oldBestOf := bestOf
+	defer func() { bestOf = oldBestOf }()
+	bestOf = 3
+
+	t.Run("decided", func(t *testing.T) {
+		// X wins, O wins with X's first mark off its line, then X wins
+		oWins := "3 3\n1 1\n3 2\n1 2\n2 2\n1 3\n"
+		out := runScripted(t, xWinsTopRow+"y\n"+oWins+"y\n"+xWinsTopRow, playSeries)
+
+		if !strings.Contains(out, "Series score: X 2 - 1 O") {
+			t.Errorf("final score missing from output:\n%s", out)
+		}
+		if !strings.Contains(out, "Player X wins the series!") {
+			t.Errorf("series winner missing from output:\n%s", out)
+		}
+		if strings.Contains(out, "Game 4") {
+			t.Error("series went on after it was decided")
+		}
+	})
+
+	t.Run("ended early", func(t *testing.T) {
+		out := runScripted(t, xWinsTopRow+"n\n", playSeries)
+
+		if !strings.Contains(out, "Series score: X 1 - 0 O") || !strings.Contains(out, "Series ended early.") {
+			t.Errorf("output does not show the series ending early:\n%s", out)
+		}
+		if strings.Contains(out, "wins the series") {
+			t.Error("undecided series has a winner")
+		}
+	})
+}